@@ -0,0 +1,318 @@
+/* Reading and writing the archive files. */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// An archive being written.  It only appears under its
+// real name once it is complete.
+type ArchiveWriter struct {
+	File       *AtomicFile
+	Plain      io.WriteCloser
+	Compress   Compressor
+	Compressed io.WriteCloser
+	Tar        *tar.Writer
+
+	// Whether entries are being stored without
+	// compression just now.
+	Stored bool
+}
+
+func NewArchiveWriter(archive string, encrypt Encrypt, compress Compressor) (*ArchiveWriter, error) {
+	archFile, err := CreateAtomic(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	archPlain, err := encrypt.WrapWriter(archFile)
+	if err != nil {
+		archFile.Abort()
+		return nil, err
+	}
+
+	archCompressed, err := compress.WrapWriter(archPlain)
+	if err != nil {
+		archFile.Abort()
+		return nil, err
+	}
+
+	w := &ArchiveWriter{archFile, archPlain, compress, archCompressed, nil, false}
+	w.Tar = tar.NewWriter(w)
+	return w, nil
+}
+
+// Writes to the compressor in use (for the tar).
+func (w *ArchiveWriter) Write(data []byte) (int, error) {
+	return w.Compressed.Write(data)
+}
+
+// Switches to storing the entries that follow without
+// compressing them, or back again.  Each switch starts a
+// new member of the compressed stream; readers carry on
+// through them as though they were one.
+func (w *ArchiveWriter) SetStored(stored bool) error {
+	store := w.Compress.Store()
+	if stored == w.Stored || store == nil {
+		return nil
+	}
+
+	err := w.Tar.Flush()
+	if err == nil {
+		err = w.Compressed.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	compress := w.Compress
+	if stored {
+		compress = store
+	}
+
+	w.Compressed, err = compress.WrapWriter(w.Plain)
+	w.Stored = stored
+	return err
+}
+
+// Finishes the archive.  A segment is left without the
+// end-of-archive marker, so that the plain contents of
+// several segments can be joined together into one.
+func (w *ArchiveWriter) Close(segment bool) (err error) {
+	// Each layer has to be closed in turn to flush it
+	// out into the next:
+	if segment {
+		err = w.Tar.Flush()
+	} else {
+		err = w.Tar.Close()
+	}
+
+	if err == nil {
+		err = w.Compressed.Close()
+	}
+
+	if err == nil {
+		err = w.Plain.Close()
+	}
+
+	if err != nil {
+		w.File.Abort()
+		return err
+	}
+
+	return w.File.Commit()
+}
+
+func (w *ArchiveWriter) Abort() {
+	w.File.Abort()
+}
+
+// Appends a member made by spoolMember to the archive.
+func (w *ArchiveWriter) AppendMember(member *os.File) error {
+	err := w.Tar.Flush()
+	if err == nil {
+		err = w.Compressed.Close()
+	}
+
+	if err == nil {
+		_, err = member.Seek(0, io.SeekStart)
+	}
+
+	if err == nil {
+		_, err = io.Copy(w.Plain, member)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	compress := w.Compress
+	if w.Stored {
+		compress = w.Compress.Store()
+	}
+
+	w.Compressed, err = compress.WrapWriter(w.Plain)
+	return err
+}
+
+// Appends entries made by bufferEntries to the archive.
+func (w *ArchiveWriter) AppendEntries(entries *bytes.Buffer) error {
+	err := w.Tar.Flush()
+	if err == nil {
+		_, err = w.Compressed.Write(entries.Bytes())
+	}
+
+	return err
+}
+
+// Writes archive entries into memory, uncompressed, so
+// that they can be added to an archive later.
+func bufferEntries(write func(*ArchiveWriter) error) (*bytes.Buffer, error) {
+	entries := new(bytes.Buffer)
+	w := &ArchiveWriter{nil, nopWriteCloser{entries}, &CompressNone{}, nopWriteCloser{entries}, nil, false}
+	w.Tar = tar.NewWriter(w)
+	err := write(w)
+	if err == nil {
+		err = w.Tar.Flush()
+	}
+
+	return entries, err
+}
+
+// Writes archive entries into a spool file, as a whole
+// member of a compressed stream, so that they can be
+// compressed apart from the archive they're going into.
+// The caller should close and remove it.
+func spoolMember(compress Compressor, write func(*ArchiveWriter) error) (*os.File, error) {
+	spool, err := ioutil.TempFile("", "backup_member")
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := compress.WrapWriter(spool)
+	if err == nil {
+		w := &ArchiveWriter{nil, nopWriteCloser{spool}, compress, compressed, nil, false}
+		w.Tar = tar.NewWriter(w)
+		err = write(w)
+		if err == nil {
+			err = w.Tar.Flush()
+		}
+
+		if err == nil {
+			err = w.Compressed.Close()
+		}
+	}
+
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+
+	return spool, nil
+}
+
+// Creates (or replaces) an archive, calling the function
+// to fill in its contents.
+func writeArchive(archive string, encrypt Encrypt, compress Compressor, write func(*tar.Writer) error) error {
+	w, err := NewArchiveWriter(archive, encrypt, compress)
+	if err != nil {
+		return err
+	}
+
+	err = write(w.Tar)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close(false)
+}
+
+// Joins the plain contents of archive segments into
+// one archive.
+func joinArchives(segments []string, archive string, encrypt Encrypt) error {
+	return writeAtomically(archive, func(archFile *os.File) error {
+		archPlain, err := encrypt.WrapWriter(archFile)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(segments); i++ {
+			err = func() error {
+				segFile, err := os.Open(segments[i])
+				if err != nil {
+					return err
+				}
+				defer segFile.Close()
+
+				segPlain, err := encrypt.WrapReader(segFile)
+				if err != nil {
+					return err
+				}
+
+				_, err = io.Copy(archPlain, segPlain)
+				return err
+			}()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return archPlain.Close()
+	})
+}
+
+// Calls the function for each entry in an archive,
+// stopping at the first error.
+func readArchive(archive string, encrypt Encrypt, read func(*tar.Header, io.Reader) error) error {
+	archFile, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer archFile.Close()
+
+	archPlain, err := encrypt.WrapReader(archFile)
+	if err != nil {
+		return err
+	}
+
+	archCompressed, err := decompressReader(archPlain)
+	if err != nil {
+		return err
+	}
+	defer archCompressed.Close()
+
+	archTar := tar.NewReader(archCompressed)
+	for {
+		hdr, err := archTar.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = read(hdr, archTar)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Copies an entry from one archive into another.
+// (Sparse files get written out in full.)
+func copyEntry(archTar *tar.Writer, hdr *tar.Header, reader io.Reader) error {
+	err := archTar.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(archTar, reader)
+	return err
+}
+
+// Copies an entry's contents into a temporary file, so
+// that they can be read more than once.  The caller
+// should close and remove it.
+func spoolEntry(reader io.Reader) (spool *os.File, size int64, err error) {
+	spool, err = ioutil.TempFile("", "backup_spool")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err = io.Copy(spool, reader)
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, 0, err
+	}
+
+	return spool, size, nil
+}
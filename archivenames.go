@@ -37,6 +37,20 @@ func (a *ArchiveNames) GetName(i int) string {
 	return a.Names[i].Name
 }
 
+// Finds the last (sorted) archive up to the given
+// edition, or the latest if nil.  Returns -1 if there
+// aren't any.
+func (a *ArchiveNames) FindAsOf(asOf *Edition) int {
+	found := -1
+	for i := 0; i < len(a.Names); i++ {
+		if asOf == nil || a.Names[i].E.Unix() <= asOf.Unix() {
+			found = i
+		}
+	}
+
+	return found
+}
+
 func (a *ArchiveNames) Len() int {
 	return len(a.Names)
 }
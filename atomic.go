@@ -0,0 +1,67 @@
+/* Writes files so that they appear either complete or
+ * not at all.
+ */
+
+package main
+
+import (
+	"os"
+)
+
+// A file written under a temporary name, which is only
+// moved into place once it has been completely written
+// and synced to disk, so that a crash or a full disk
+// can't leave a truncated file behind.
+type AtomicFile struct {
+	*os.File
+	Filename string
+}
+
+func CreateAtomic(filename string) (*AtomicFile, error) {
+	f, err := os.Create(filename + TempSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AtomicFile{f, filename}, nil
+}
+
+// Moves the file into place.
+func (f *AtomicFile) Commit() error {
+	err := f.Sync()
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), f.Filename)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Throws the file away.
+func (f *AtomicFile) Abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func writeAtomically(filename string, write func(*os.File) error) error {
+	f, err := CreateAtomic(filename)
+	if err != nil {
+		return err
+	}
+
+	err = write(f.File)
+	if err != nil {
+		f.Abort()
+		return err
+	}
+
+	return f.Commit()
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 type Job struct {
@@ -23,6 +24,57 @@ type Job struct {
 
 	// The passphrase to encrypt with.
 	Passphrase string
+
+	// Which editions to keep when pruning.
+	Keep Retention
+
+	// How often to checkpoint a backup, so that it can be
+	// resumed if interrupted.  Defaults to every 15 minutes.
+	CheckpointMinutes int
+
+	// Whether to stay on the filesystem that Path is on,
+	// rather than descending into other filesystems
+	// mounted underneath it.
+	OneFileSystem bool
+
+	// Mount points to descend into even so.
+	CrossMounts []string
+
+	// Whether to back up device files and named pipes,
+	// rather than skipping them.
+	SpecialFiles bool
+
+	// Whether to store large files in chunks, so that
+	// each edition only stores the parts that changed.
+	Chunked bool
+
+	// How to compress the archives: "gzip" (the default),
+	// "zstd", "xz" or "none".
+	Compression string
+
+	// The compression level, or 0 for the default.
+	CompressionLevel int
+
+	// File extensions (like ".jpg") and formats (like
+	// "jpeg") to store without compression, because they
+	// are compressed already.  Defaults to all the formats
+	// we recognise.
+	Uncompressed []string
+
+	// How many files to hash and compress at once.
+	// Defaults to one per CPU.
+	Workers int
+
+	// How many times to read a file again if it changes
+	// while we're reading it.  Defaults to 3; set it
+	// negative never to.
+	Retries int
+
+	// How to tell whether a file might have changed, and so
+	// needs hashing again: "mtime" (the default) if its
+	// mtime has changed at all, "metadata" if its size,
+	// ctime or inode has changed too, or "always".
+	ChangeDetection string
 }
 
 func readRunningJobs(jobPath string, edition *Edition) (runningJobs []*RunningJob, err error) {
@@ -34,6 +86,11 @@ func readRunningJobs(jobPath string, edition *Edition) (runningJobs []*RunningJo
 	defer f.Close()
 	decoder := json.NewDecoder(f)
 
+	absJobPath, err := filepath.Abs(jobPath)
+	if err != nil {
+		return runningJobs, err
+	}
+
 	// Check eof, because merlin's version of go doesn't have decoder.More()
 	finished := false
 	for !finished {
@@ -47,14 +104,43 @@ func readRunningJobs(jobPath string, edition *Edition) (runningJobs []*RunningJo
 				return runningJobs, err
 			}
 		} else {
-			runningJobs = append(runningJobs, &RunningJob{job, edition})
+			runningJobs = append(runningJobs, &RunningJob{job, edition, absJobPath})
 		}
 	}
 
 	return runningJobs, err
 }
 
-func RunBackup(jobPath string, filter *Filters, prefix string, removeAfterEdition *Edition) (err error) {
+// Composes the list of non-job specific excludes out of
+// all running jobs (all jobs must exclude these!)
+func addNonSpecificExcludes(runningJobs []*RunningJob, filter *Filters) error {
+	for i := 0; i < len(runningJobs); i++ {
+		excl, err := runningJobs[i].GetNonSpecificExcludes()
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < len(excl); j++ {
+			filter.AddExclude(excl[j])
+		}
+	}
+
+	return nil
+}
+
+// Sets OneFileSystem on every job, if the command line
+// said to (nil means leave each job's own setting).
+func overrideOneFileSystem(runningJobs []*RunningJob, oneFileSystem *bool) {
+	if oneFileSystem == nil {
+		return
+	}
+
+	for i := 0; i < len(runningJobs); i++ {
+		runningJobs[i].J.OneFileSystem = *oneFileSystem
+	}
+}
+
+func RunBackup(jobPath string, filter *Filters, prefix string, removeAfterEdition *Edition, resume bool, oneFileSystem *bool) (err error) {
 	// Decree an edition for this backup:
 	edition := EditionFromNow()
 	fmt.Printf("Running backup edition %s\n", edition.String())
@@ -66,23 +152,47 @@ func RunBackup(jobPath string, filter *Filters, prefix string, removeAfterEditio
 		return err
 	}
 
-	// Compose the list of non-job specific excludes out of
-	// all running jobs (all jobs must exclude these!)
+	err = addNonSpecificExcludes(runningJobs, filter)
+	if err != nil {
+		return err
+	}
+
+	overrideOneFileSystem(runningJobs, oneFileSystem)
+
+	// Run all the jobs
 	for i := 0; i < len(runningJobs); i++ {
-		excl, err := runningJobs[i].GetNonSpecificExcludes()
+		encrypt := NewEncryptKblob(runningJobs[i].J.Passphrase)
+		var compress Compressor
+		compress, err = NewCompressor(runningJobs[i].J.Compression, runningJobs[i].J.CompressionLevel)
 		if err != nil {
 			return err
 		}
 
-		for j := 0; j < len(excl); j++ {
-			filter.AddExclude(excl[j])
+		err = runningJobs[i].DoBackup(filter, prefix, encrypt, compress, removeAfterEdition, resume)
+		if err != nil {
+			return err
 		}
 	}
 
-	// Run all the jobs
+	return nil
+}
+
+func RunDiff(jobPath string, filter *Filters, prefix string, oneFileSystem *bool) error {
+	runningJobs, err := readRunningJobs(jobPath, nil)
+	if err != nil {
+		return err
+	}
+
+	err = addNonSpecificExcludes(runningJobs, filter)
+	if err != nil {
+		return err
+	}
+
+	overrideOneFileSystem(runningJobs, oneFileSystem)
+
 	for i := 0; i < len(runningJobs); i++ {
 		encrypt := NewEncryptKblob(runningJobs[i].J.Passphrase)
-		err = runningJobs[i].DoBackup(filter, prefix, encrypt, removeAfterEdition)
+		err = runningJobs[i].DoDiff(filter, prefix, encrypt)
 		if err != nil {
 			return err
 		}
@@ -110,7 +220,81 @@ func RunListEditions(jobPath string) error {
 	return nil
 }
 
-func RunUnpack(jobPath string, filter Filter, prefix string, repl Replacement, what int) (err error) {
+func RunStats(jobPath string) error {
+	runningJobs, err := readRunningJobs(jobPath, nil)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(runningJobs); i++ {
+		encrypt := NewEncryptKblob(runningJobs[i].J.Passphrase)
+		err = runningJobs[i].DoStats(encrypt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RunRebuildDb(jobPath string) error {
+	runningJobs, err := readRunningJobs(jobPath, nil)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(runningJobs); i++ {
+		encrypt := NewEncryptKblob(runningJobs[i].J.Passphrase)
+		err = runningJobs[i].DoRebuildDb(encrypt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RunPrune(jobPath string) error {
+	runningJobs, err := readRunningJobs(jobPath, nil)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(runningJobs); i++ {
+		encrypt := NewEncryptKblob(runningJobs[i].J.Passphrase)
+		var compress Compressor
+		compress, err = NewCompressor(runningJobs[i].J.Compression, runningJobs[i].J.CompressionLevel)
+		if err != nil {
+			return err
+		}
+
+		err = runningJobs[i].DoPrune(encrypt, compress)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RunExport(jobPath string, filter Filter, repl Replacement, asOf *Edition, outDir string, merge bool) error {
+	runningJobs, err := readRunningJobs(jobPath, nil)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(runningJobs); i++ {
+		encrypt := NewEncryptKblob(runningJobs[i].J.Passphrase)
+		err = runningJobs[i].DoExport(filter, repl, encrypt, asOf, outDir, merge)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RunUnpack(jobPath string, filter Filter, prefix string, repl Replacement, asOf *Edition, what int, skipXattrs []string) (err error) {
 	// We don't need an edition here:
 	runningJobs, err := readRunningJobs(jobPath, nil)
 	if err != nil {
@@ -120,7 +304,7 @@ func RunUnpack(jobPath string, filter Filter, prefix string, repl Replacement, w
 	// Run all the jobs
 	for i := 0; i < len(runningJobs); i++ {
 		encrypt := NewEncryptKblob(runningJobs[i].J.Passphrase)
-		err = runningJobs[i].DoUnpack(filter, prefix, repl, encrypt, what)
+		err = runningJobs[i].DoUnpack(filter, prefix, repl, encrypt, asOf, what, skipXattrs)
 		if err != nil {
 			return err
 		}
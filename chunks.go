@@ -0,0 +1,430 @@
+/* Chunked files.  A large file that keeps changing (a VM
+ * image, say, or a mailbox) can be stored as a list of
+ * chunks, split wherever its contents say rather than at
+ * fixed offsets, so that a change in one place leaves the
+ * other chunks alone.  Each chunk is stored once, as an
+ * archive entry named after its hash; the file itself gets
+ * an entry with no contents of its own, and PAX records
+ * giving its real size, its hash and the chunks it's made
+ * of (unless there are too many for a PAX header, in which
+ * case only the database knows them).
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	ChunkPrefix  = ".chunks/"
+	ChunkKey     = "KAIEKKRIN.backup.chunked"
+	ChunkHashKey = "KAIEKKRIN.backup.chunked_hash"
+
+	// The chunks in order, as "offset:hash" separated by
+	// spaces.
+	ChunkListKey = "KAIEKKRIN.backup.chunks"
+
+	// Readers refuse PAX headers over 1MiB, and the list
+	// shares its header with any xattrs.  This is enough for
+	// about 10000 chunks.
+	ChunkListMaxLen = 768 << 10
+
+	// Files smaller than this are never chunked.
+	ChunkMinFileSize = 1 << 20
+
+	ChunkMinSize = 256 << 10
+	ChunkMaxSize = 4 << 20
+
+	// A chunk ends where the top 20 bits of the rolling
+	// hash are zero, which gives about 1MiB on average.
+	chunkMask = uint64(0xfffff) << 44
+)
+
+// Random values for the rolling hash, one for each byte.
+// Any will do, but they must never change, or none of the
+// chunks already stored would match again.
+var gearTable [256]uint64
+
+func init() {
+	// (splitmix64.)
+	seed := uint64(0x6b6169656b6b7269)
+	for i := 0; i < len(gearTable); i++ {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// Splits a stream into content-defined chunks.
+type Chunker struct {
+	R   *bufio.Reader
+	Buf []byte
+}
+
+func NewChunker(reader io.Reader) *Chunker {
+	return &Chunker{bufio.NewReader(reader), make([]byte, 0, ChunkMaxSize)}
+}
+
+// Returns the next chunk, or io.EOF after the last one.
+// The chunk is only good until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	chunk := c.Buf[:0]
+	hash := uint64(0)
+	for len(chunk) < ChunkMaxSize {
+		b, err := c.R.ReadByte()
+		if err == io.EOF {
+			if len(chunk) == 0 {
+				return nil, io.EOF
+			}
+
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, b)
+		hash = (hash << 1) + gearTable[b]
+		if len(chunk) >= ChunkMinSize && (hash&chunkMask) == 0 {
+			break
+		}
+	}
+
+	c.Buf = chunk
+	return chunk, nil
+}
+
+func chunkEntryName(hash string) string {
+	return ChunkPrefix + hash
+}
+
+// Tells whether an archive entry is a chunk.
+func isChunkEntry(hdr *tar.Header) bool {
+	return strings.HasPrefix(hdr.Name, ChunkPrefix) && hdr.Typeflag == tar.TypeReg
+}
+
+// Tells whether an archive entry is a file stored in
+// chunks.
+func isChunkedHeader(hdr *tar.Header) bool {
+	_, found := hdr.PAXRecords[ChunkKey]
+	return found
+}
+
+// Makes a header for the whole contents of a file stored
+// in chunks, with the same mode etc.
+func clearChunkedHeader(hdr *tar.Header) (*tar.Header, error) {
+	size, err := strconv.ParseInt(hdr.PAXRecords[ChunkKey], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return clearRecords(hdr, size, ChunkKey, ChunkHashKey, ChunkListKey), nil
+}
+
+// Lists chunks for a header, or returns "" if there are
+// too many.
+func formatChunkList(chunks []FileChunk) string {
+	var list strings.Builder
+	for i := 0; i < len(chunks); i++ {
+		if i > 0 {
+			list.WriteByte(' ')
+		}
+
+		fmt.Fprintf(&list, "%d:%s", chunks[i].Start, chunks[i].Hash)
+		if list.Len() > ChunkListMaxLen {
+			return ""
+		}
+	}
+
+	return list.String()
+}
+
+// Reads the chunks that a chunked file's header lists, or
+// returns nil if it doesn't list them.  (They have no
+// edition.)
+func parseChunkList(hdr *tar.Header) ([]FileChunk, error) {
+	list, found := hdr.PAXRecords[ChunkListKey]
+	if !found {
+		return nil, nil
+	}
+
+	size, err := strconv.ParseInt(hdr.PAXRecords[ChunkKey], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(list)
+	chunks := make([]FileChunk, len(fields))
+	for i := 0; i < len(fields); i++ {
+		colon := strings.IndexByte(fields[i], ':')
+		if colon < 0 {
+			return nil, errors.New(fmt.Sprintf("Bad chunk %s", fields[i]))
+		}
+
+		chunks[i].Start, err = strconv.ParseInt(fields[i][:colon], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		chunks[i].Hash = fields[i][colon+1:]
+		if i > 0 {
+			chunks[i-1].Size = chunks[i].Start - chunks[i-1].Start
+		}
+	}
+
+	if len(chunks) > 0 {
+		chunks[len(chunks)-1].Size = size - chunks[len(chunks)-1].Start
+	}
+
+	for i := 0; i < len(chunks); i++ {
+		if chunks[i].Size <= 0 {
+			return nil, errors.New(fmt.Sprintf("Bad chunk offset %d", chunks[i].Start))
+		}
+	}
+
+	return chunks, nil
+}
+
+// Tells whether a file should be stored in chunks.
+func (r *RunningJob) isChunked(info os.FileInfo) bool {
+	return r.J.Chunked && info.Size() >= ChunkMinFileSize
+}
+
+// Splits a file into chunks, archiving any that aren't in
+// the backup already, and hashing the whole contents into
+// `h'.
+func (r *RunningJob) chunkFile(prefixedPath string, seenDb Seen, archive *ArchiveWriter, h io.Writer) ([]FileChunk, error) {
+	f, err := os.Open(prefixedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var chunks []FileChunk
+	size := int64(0)
+	chunker := NewChunker(io.TeeReader(f, h))
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		err = seenDb.AddChunk(hash, int64(len(data)), func() error {
+			return r.backupChunk(hash, data, archive.Tar)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		chunks = append(chunks, FileChunk{hash, size, int64(len(data)), nil})
+		size += int64(len(data))
+	}
+}
+
+// Writes a file as the list of chunks it was split into.
+// `hash' is the hash of its whole contents.
+func (r *RunningJob) backupChunked(prefixedPath string, path string, info os.FileInfo, hash []byte, chunks []FileChunk, seenDb Seen, archive *ArchiveWriter) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = path
+	AssignUserIds(info, hdr)
+	err = AssignXattrs(prefixedPath, info, hdr)
+	if err != nil {
+		return err
+	}
+
+	hdr.ModTime = info.ModTime()
+
+	size := int64(0)
+	if len(chunks) > 0 {
+		size = chunks[len(chunks)-1].Start + chunks[len(chunks)-1].Size
+	}
+
+	hdr.Size = 0
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+
+	hdr.PAXRecords[ChunkKey] = strconv.FormatInt(size, 10)
+	hdr.PAXRecords[ChunkHashKey] = hex.EncodeToString(hash)
+	if list := formatChunkList(chunks); list != "" {
+		hdr.PAXRecords[ChunkListKey] = list
+	}
+
+	err = archive.Tar.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	return seenDb.SetFileChunks(path, chunks)
+}
+
+func (r *RunningJob) backupChunk(hash string, data []byte, archTar *tar.Writer) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     chunkEntryName(hash),
+		Size:     int64(len(data)),
+		Mode:     0600,
+		ModTime:  r.E.When,
+	}
+
+	err := archTar.WriteHeader(hdr)
+	if err == nil {
+		_, err = archTar.Write(data)
+	}
+
+	return err
+}
+
+// Collects the chunks of the files being unpacked, so
+// that they can be put back together once we've seen
+// all the archives.
+type chunkSpool struct {
+	// The chunks of each file, in order.
+	Files map[string][]*FileChunk
+
+	// The size of each chunk we need.
+	Needed map[string]int64
+
+	// Where each chunk we've got is in the spool file.
+	Offsets map[string]int64
+
+	F    *os.File
+	Size int64
+}
+
+func newChunkSpool(seenDb Seen, asOf *Edition, filter Filter) (*chunkSpool, error) {
+	s := &chunkSpool{
+		make(map[string][]*FileChunk),
+		make(map[string]int64),
+		make(map[string]int64),
+		nil,
+		0,
+	}
+
+	err := seenDb.ListLatestChunks(asOf, func(filename string, chunk *FileChunk) error {
+		if filter.Include(filename) {
+			s.Files[filename] = append(s.Files[filename], chunk)
+			s.Needed[chunk.Hash] = chunk.Size
+		}
+
+		return nil
+	})
+
+	return s, err
+}
+
+// Makes sure we'll keep the chunks of a chunked file that
+// the database knows nothing about, going by its header.
+func (s *chunkSpool) AddHeader(hdr *tar.Header) error {
+	if len(s.Files[hdr.Name]) > 0 {
+		return nil
+	}
+
+	chunks, err := parseChunkList(hdr)
+	for i := 0; i < len(chunks); i++ {
+		s.Needed[chunks[i].Hash] = chunks[i].Size
+	}
+
+	return err
+}
+
+// Tells whether there are chunks we need and haven't got.
+func (s *chunkSpool) Missing() bool {
+	for hash := range s.Needed {
+		if _, found := s.Offsets[hash]; !found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keeps the contents of a chunk entry, if we need them.
+func (s *chunkSpool) Add(hdr *tar.Header, reader io.Reader) (err error) {
+	hash := strings.TrimPrefix(hdr.Name, ChunkPrefix)
+	size, needed := s.Needed[hash]
+	if _, found := s.Offsets[hash]; !needed || found {
+		return nil
+	}
+
+	if s.F == nil {
+		s.F, err = ioutil.TempFile("", "backup_chunks")
+		if err != nil {
+			return err
+		}
+	}
+
+	written, err := io.Copy(s.F, reader)
+	if err != nil {
+		return err
+	}
+
+	if written != size {
+		return errors.New(fmt.Sprintf("%s : Expected %d bytes, found %d", hdr.Name, size, written))
+	}
+
+	s.Offsets[hash] = s.Size
+	s.Size += written
+	return nil
+}
+
+// Returns the whole contents of a file, from the chunks
+// the database lists or, failing that, its header.
+func (s *chunkSpool) Reader(hdr *tar.Header) (io.Reader, error) {
+	chunks := s.Files[hdr.Name]
+	if len(chunks) == 0 {
+		fromHeader, err := parseChunkList(hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < len(fromHeader); i++ {
+			chunks = append(chunks, &fromHeader[i])
+		}
+	}
+
+	if len(chunks) == 0 {
+		return nil, errors.New("No chunks in database or archive")
+	}
+
+	readers := make([]io.Reader, len(chunks))
+	for i := 0; i < len(chunks); i++ {
+		offset, found := s.Offsets[chunks[i].Hash]
+		if !found && chunks[i].E == nil {
+			return nil, errors.New(fmt.Sprintf("Missing chunk %s", chunks[i].Hash))
+		} else if !found {
+			return nil, errors.New(fmt.Sprintf("Missing chunk %s from edition %s", chunks[i].Hash, chunks[i].E.String()))
+		}
+
+		readers[i] = io.NewSectionReader(s.F, offset, chunks[i].Size)
+	}
+
+	return io.MultiReader(readers...), nil
+}
+
+func (s *chunkSpool) Close() {
+	if s.F != nil {
+		s.F.Close()
+		os.Remove(s.F.Name())
+	}
+}
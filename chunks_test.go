@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Splits the data into chunks, checking that they put it
+// back together.
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+	chunker := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+
+	if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+		t.Fatalf("Chunks of %d bytes don't make up the data", len(data))
+	}
+
+	return chunks
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	tests := []struct {
+		Name string
+		Data []byte
+
+		// The sizes of the chunks, if we know them.
+		Sizes []int
+	}{
+		{"empty", nil, nil},
+		{"one byte", []byte{1}, []int{1}},
+		{"shorter than a chunk", randomData(1, ChunkMinSize-1), []int{ChunkMinSize - 1}},
+		// (Zeroes never make the hash end a chunk.)
+		{"zeroes", make([]byte, 2*ChunkMaxSize+10), []int{ChunkMaxSize, ChunkMaxSize, 10}},
+		{"random", randomData(2, 16<<20), nil},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		chunks := chunkAll(t, tests[i].Data)
+		sizes := make([]int, len(chunks))
+		for j := 0; j < len(chunks); j++ {
+			sizes[j] = len(chunks[j])
+			if sizes[j] > ChunkMaxSize || (sizes[j] < ChunkMinSize && j < len(chunks)-1) {
+				t.Errorf("%s : Chunk %d has %d bytes", tests[i].Name, j, sizes[j])
+			}
+		}
+
+		if tests[i].Sizes != nil && !reflect.DeepEqual(sizes, tests[i].Sizes) {
+			t.Errorf("%s : Made chunks of %v, expected %v", tests[i].Name, sizes, tests[i].Sizes)
+		}
+	}
+}
+
+// Inserting something near the start should leave most of
+// the chunks as they were.
+func TestChunkerInsertion(t *testing.T) {
+	data := randomData(3, 16<<20)
+	changed := append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...)
+
+	before := make(map[string]struct{})
+	chunks := chunkAll(t, data)
+	for i := 0; i < len(chunks); i++ {
+		before[string(chunks[i])] = struct{}{}
+	}
+
+	after := chunkAll(t, changed)
+	kept := 0
+	for i := 0; i < len(after); i++ {
+		if _, found := before[string(after[i])]; found {
+			kept += 1
+		}
+	}
+
+	if kept < len(chunks)-2 {
+		t.Errorf("Kept %d of %d chunks", kept, len(chunks))
+	}
+}
+
+func TestChunkList(t *testing.T) {
+	chunks := []FileChunk{{"aa", 0, 10, nil}, {"bb", 10, 5, nil}, {"cc", 15, 1, nil}}
+	hdr := &tar.Header{PAXRecords: map[string]string{
+		ChunkKey:     "16",
+		ChunkListKey: formatChunkList(chunks),
+	}}
+
+	parsed, err := parseChunkList(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(parsed, chunks) {
+		t.Errorf("Parsed %v, expected %v", parsed, chunks)
+	}
+
+	tests := []struct {
+		Size string
+		List string
+	}{
+		{"16", "0:aa 10"},
+		{"16", "0:aa x:bb"},
+		{"16", "0:aa 16:bb"},
+		{"16", "10:aa 0:bb"},
+		{"", "0:aa"},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		hdr.PAXRecords[ChunkKey] = tests[i].Size
+		hdr.PAXRecords[ChunkListKey] = tests[i].List
+		parsed, err = parseChunkList(hdr)
+		if err == nil {
+			t.Errorf("%s (%s bytes) : Parsed %v", tests[i].List, tests[i].Size, parsed)
+		}
+	}
+
+	// Too many chunks to list:
+	many := make([]FileChunk, ChunkListMaxLen/10)
+	for i := 0; i < len(many); i++ {
+		many[i] = FileChunk{strconv.Itoa(i), int64(i), 1, nil}
+	}
+
+	if list := formatChunkList(many); list != "" {
+		t.Errorf("Listed %d chunks in %d bytes", len(many), len(list))
+	}
+}
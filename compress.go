@@ -0,0 +1,271 @@
+/* A compression interface for the archives, which sits
+ * between the encryption and the tar.  Each format starts
+ * with its own magic number, so reading an archive works
+ * out which one it was written with.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	Compression_Gzip = "gzip"
+	Compression_Zstd = "zstd"
+	Compression_Xz   = "xz"
+	Compression_None = "none"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+type Compressor interface {
+	WrapWriter(io.Writer) (io.WriteCloser, error)
+
+	// Returns a cheaper way of writing the same format,
+	// for contents that won't compress, or nil if there
+	// isn't one.
+	Store() Compressor
+}
+
+// `level' is the compression level, or 0 for the
+// format's default.  (xz doesn't have one.)
+func NewCompressor(compression string, level int) (Compressor, error) {
+	switch compression {
+	case "", Compression_Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		return &CompressGzip{level}, nil
+
+	case Compression_Zstd:
+		return &CompressZstd{level}, nil
+
+	case Compression_Xz:
+		return &CompressXz{}, nil
+
+	case Compression_None:
+		return &CompressNone{}, nil
+
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown compression %s", compression))
+	}
+}
+
+type CompressGzip struct {
+	Level int
+}
+
+func (c *CompressGzip) WrapWriter(writer io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(writer, c.Level)
+}
+
+func (c *CompressGzip) Store() Compressor {
+	if c.Level == gzip.NoCompression {
+		return nil
+	}
+
+	return &CompressGzip{gzip.NoCompression}
+}
+
+type CompressZstd struct {
+	Level int
+}
+
+func (c *CompressZstd) WrapWriter(writer io.Writer) (io.WriteCloser, error) {
+	if c.Level == 0 {
+		return zstd.NewWriter(writer)
+	}
+
+	return zstd.NewWriter(writer, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+}
+
+func (c *CompressZstd) Store() Compressor {
+	return &CompressZstdRaw{}
+}
+
+// zstd has no level without compression, so we write the
+// frames ourselves, out of raw (uncompressed) blocks.
+type CompressZstdRaw struct {
+}
+
+func (c *CompressZstdRaw) WrapWriter(writer io.Writer) (io.WriteCloser, error) {
+	return &zstdRawWriter{writer, make([]byte, 0, zstdBlockMaxSize), false}, nil
+}
+
+func (c *CompressZstdRaw) Store() Compressor {
+	return nil
+}
+
+// The largest block a frame can have, which is also the
+// window size we declare (not that raw blocks need one).
+const zstdBlockMaxSize = 128 << 10
+
+type zstdRawWriter struct {
+	Writer  io.Writer
+	Block   []byte
+	Started bool
+}
+
+func (w *zstdRawWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		// We only know that a block isn't the last one once
+		// there's more to come:
+		if len(w.Block) == zstdBlockMaxSize {
+			err := w.writeBlock(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.Block[len(w.Block):zstdBlockMaxSize], data)
+		w.Block = w.Block[:len(w.Block)+n]
+		data = data[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (w *zstdRawWriter) Close() error {
+	return w.writeBlock(true)
+}
+
+func (w *zstdRawWriter) writeBlock(last bool) error {
+	if !w.Started {
+		// The frame header has no flags set, and a window
+		// of 128KiB:
+		_, err := w.Writer.Write(append(append([]byte(nil), zstdMagic...), 0x00, 7<<3))
+		if err != nil {
+			return err
+		}
+
+		w.Started = true
+	}
+
+	// (A raw block has type 0.)
+	header := uint32(len(w.Block)) << 3
+	if last {
+		header |= 1
+	}
+
+	_, err := w.Writer.Write([]byte{byte(header), byte(header >> 8), byte(header >> 16)})
+	if err == nil {
+		_, err = w.Writer.Write(w.Block)
+	}
+
+	w.Block = w.Block[:0]
+	return err
+}
+
+type CompressXz struct {
+}
+
+func (c *CompressXz) WrapWriter(writer io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(writer)
+}
+
+// (The xz package can't write without compressing.)
+func (c *CompressXz) Store() Compressor {
+	return nil
+}
+
+type CompressNone struct {
+}
+
+func (c *CompressNone) WrapWriter(writer io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{writer}, nil
+}
+
+func (c *CompressNone) Store() Compressor {
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (w nopWriteCloser) Close() error {
+	return nil
+}
+
+// Works out how an archive's plain contents were
+// compressed.  Anything we don't recognise is taken to
+// be an uncompressed tar.
+func sniffCompression(reader *bufio.Reader) string {
+	// (A short read just means a short archive.)
+	magic, _ := reader.Peek(len(xzMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return Compression_Gzip
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		return Compression_Zstd
+
+	case bytes.HasPrefix(magic, xzMagic):
+		return Compression_Xz
+
+	default:
+		return Compression_None
+	}
+}
+
+// Unwraps an archive's plain contents, whichever way they
+// were compressed.
+func decompressReader(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+	switch sniffCompression(buffered) {
+	case Compression_Gzip:
+		return gzip.NewReader(buffered)
+
+	case Compression_Zstd:
+		d, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.IOReadCloser(), nil
+
+	case Compression_Xz:
+		x, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+
+		return ioutil.NopCloser(x), nil
+
+	default:
+		return ioutil.NopCloser(buffered), nil
+	}
+}
+
+// The usual file suffix for a tar compressed that way.
+func compressionSuffix(compression string) string {
+	switch compression {
+	case Compression_Gzip:
+		return ".tar.gz"
+
+	case Compression_Zstd:
+		return ".tar.zst"
+
+	case Compression_Xz:
+		return ".tar.xz"
+
+	default:
+		return ".tar"
+	}
+}
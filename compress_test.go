@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSniffCompression(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Data        []byte
+		Compression string
+	}{
+		{"empty", nil, Compression_None},
+		{"gzip", []byte{0x1f, 0x8b, 8, 0}, Compression_Gzip},
+		{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}, Compression_Zstd},
+		{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0, 0, 4}, Compression_Xz},
+		{"short xz", []byte{0xfd, '7', 'z'}, Compression_None},
+		{"half of gzip", []byte{0x1f}, Compression_None},
+		{"tar", append([]byte("some/file"), make([]byte, 503)...), Compression_None},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		reader := bufio.NewReader(bytes.NewReader(tests[i].Data))
+		compression := sniffCompression(reader)
+		if compression != tests[i].Compression {
+			t.Errorf("%s : Found %s, expected %s", tests[i].Name, compression, tests[i].Compression)
+		}
+
+		// Sniffing mustn't use anything up:
+		rest, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(rest, tests[i].Data) {
+			t.Errorf("%s : Lost data sniffing it", tests[i].Name)
+		}
+	}
+}
+
+// Whatever we write, we can read back without being told
+// how it was compressed.
+func TestCompressorsSniffed(t *testing.T) {
+	data := bytes.Repeat([]byte("some contents "), 1000)
+	compressions := []string{Compression_Gzip, Compression_Zstd, Compression_Xz, Compression_None}
+	for i := 0; i < len(compressions); i++ {
+		compress, err := NewCompressor(compressions[i], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// (Storing must give the same format.)
+		writers := []Compressor{compress}
+		if compress.Store() != nil {
+			writers = append(writers, compress.Store())
+		}
+
+		for j := 0; j < len(writers); j++ {
+			var compressed bytes.Buffer
+			w, err := writers[j].WrapWriter(&compressed)
+			if err == nil {
+				_, err = w.Write(data)
+			}
+
+			if err == nil {
+				err = w.Close()
+			}
+
+			if err != nil {
+				t.Fatalf("%s : %s", compressions[i], err.Error())
+			}
+
+			if sniffed := sniffCompression(bufio.NewReader(bytes.NewReader(compressed.Bytes()))); sniffed != compressions[i] {
+				t.Errorf("%s : Sniffed %s", compressions[i], sniffed)
+			}
+
+			r, err := decompressReader(&compressed)
+			if err != nil {
+				t.Fatalf("%s : %s", compressions[i], err.Error())
+			}
+
+			read, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(read, data) {
+				t.Errorf("%s : Read back %d bytes, expected %d (%v)", compressions[i], len(read), len(data), err)
+			}
+		}
+	}
+}
+
+// Storing writes the contents as they are, however well
+// they would compress, in members that read back in turn.
+func TestCompressorsStore(t *testing.T) {
+	sizes := []int{0, 1, zstdBlockMaxSize, zstdBlockMaxSize + 1, 3*zstdBlockMaxSize + 10}
+	compressions := []string{Compression_Gzip, Compression_Zstd}
+	for i := 0; i < len(compressions); i++ {
+		compress, err := NewCompressor(compressions[i], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var compressed, expected bytes.Buffer
+		for j := 0; j < len(sizes); j++ {
+			data := bytes.Repeat([]byte{byte(j)}, sizes[j])
+			w, err := compress.Store().WrapWriter(&compressed)
+			if err == nil {
+				_, err = w.Write(data)
+			}
+
+			if err == nil {
+				err = w.Close()
+			}
+
+			if err != nil {
+				t.Fatalf("%s : %s", compressions[i], err.Error())
+			}
+
+			expected.Write(data)
+		}
+
+		if compressed.Len() < expected.Len() {
+			t.Errorf("%s : Stored %d bytes in %d", compressions[i], expected.Len(), compressed.Len())
+		}
+
+		r, err := decompressReader(&compressed)
+		if err != nil {
+			t.Fatalf("%s : %s", compressions[i], err.Error())
+		}
+
+		read, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(read, expected.Bytes()) {
+			t.Errorf("%s : Read back %d bytes, expected %d (%v)", compressions[i], len(read), expected.Len(), err)
+		}
+	}
+}
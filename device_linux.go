@@ -0,0 +1,42 @@
+/* Linux specific package for telling filesystems and
+ * files apart in backup.
+ */
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Gets the id of the device holding the file, if known.
+func GetDeviceId(info os.FileInfo) (uint64, bool) {
+	if sys, found := info.Sys().(*syscall.Stat_t); found {
+		return uint64(sys.Dev), true
+	}
+
+	return 0, false
+}
+
+// Gets an id shared by all the hard links to the file,
+// if it has more than one.
+func GetHardLinkId(info os.FileInfo) (HardLinkId, bool) {
+	if sys, found := info.Sys().(*syscall.Stat_t); found && sys.Nlink > 1 {
+		return HardLinkId{uint64(sys.Dev), uint64(sys.Ino)}, true
+	}
+
+	return HardLinkId{}, false
+}
+
+// Gets what we can tell about whether the file changed
+// without reading it.
+func GetFileMeta(info os.FileInfo) *FileMeta {
+	meta := &FileMeta{info.ModTime(), info.Size(), time.Time{}, 0}
+	if sys, found := info.Sys().(*syscall.Stat_t); found {
+		meta.Ctime = time.Unix(int64(sys.Ctim.Sec), int64(sys.Ctim.Nsec))
+		meta.Inode = uint64(sys.Ino)
+	}
+
+	return meta
+}
@@ -0,0 +1,26 @@
+/* Windows specific package for telling filesystems and
+ * files apart in backup.
+ */
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+func GetDeviceId(info os.FileInfo) (uint64, bool) {
+	// Windows doesn't tell us this, so every file is
+	// on the same filesystem.
+	return 0, false
+}
+
+func GetHardLinkId(info os.FileInfo) (HardLinkId, bool) {
+	// Likewise, we don't know about hard links.
+	return HardLinkId{}, false
+}
+
+func GetFileMeta(info os.FileInfo) *FileMeta {
+	// Nor do we have a ctime or inode.
+	return &FileMeta{info.ModTime(), info.Size(), time.Time{}, 0}
+}
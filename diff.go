@@ -0,0 +1,104 @@
+/* Compares the latest edition with the files it was
+ * taken from.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+func (r *RunningJob) DoDiff(filter *Filters, prefix string, encrypt Encrypt) (err error) {
+	fmt.Printf("Running diff %s ...\n", r.J.BaseName)
+	fullFilter := r.getFullFilter(filter)
+
+	// Open up the database:
+	fmt.Printf("Opening database %s\n", r.GetDbFilename())
+	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, r.E)
+	if err != nil {
+		return err
+	}
+	defer closeReadOnly(seenDb, &err)
+
+	newCount, changedCount, deletedCount, unchangedCount, errorCount := 0, 0, 0, 0, 0
+	seen := make(map[string]struct{})
+	unreadable, skipped, err := r.walkTree(fullFilter, prefix, func(prefixedPath string, path string, info os.FileInfo) error {
+		// Only regular files go in the database:
+		if (info.Mode() & os.ModeType) != 0 {
+			return nil
+		}
+
+		seen[path] = struct{}{}
+		entry, err := seenDb.GetLatest(path, nil)
+		if err != nil {
+			return err
+		}
+
+		if entry == nil || entry.IsDeleted() {
+			fmt.Printf("%s : New\n", path)
+			newCount += 1
+			return nil
+		}
+
+		// A hard link has whatever contents its target
+		// has now -- or if its target has gone, the
+		// contents it had then (which it has its own hash
+		// of):
+		if entry.Link != "" {
+			target, err := seenDb.GetLatest(entry.Link, nil)
+			if err != nil {
+				return err
+			}
+
+			if target != nil && !target.IsDeleted() {
+				entry = target
+			}
+		}
+
+		hash, err := getHash(prefixedPath)
+		if err != nil {
+			fmt.Printf("%s : %s\n", path, err.Error())
+			errorCount += 1
+		} else if !bytes.Equal(hash, entry.Hash) {
+			fmt.Printf("%s : Changed\n", path)
+			changedCount += 1
+		} else if !info.ModTime().Equal(entry.Mtime) {
+			fmt.Printf("%s : Unchanged (different mtime)\n", path)
+			unchangedCount += 1
+		} else {
+			fmt.Printf("%s : Unchanged\n", path)
+			unchangedCount += 1
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	mightBeDeleted := r.getMightBeDeleted(fullFilter, unreadable, skipped)
+	err = seenDb.ListLatest(nil, func(filename string, entry *SeenEntry) error {
+		if _, found := seen[filename]; !found && !entry.IsDeleted() && mightBeDeleted(filename) {
+			fmt.Printf("%s : Deleted\n", filename)
+			deletedCount += 1
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s : %d new, %d changed, %d deleted, %d unchanged, %d errors\n",
+		r.J.BaseName, newCount, changedCount, deletedCount, unchangedCount, errorCount)
+	if newCount+changedCount+deletedCount+errorCount > 0 {
+		return errors.New(fmt.Sprintf("%s : The backup differs from %s", r.J.BaseName, prefix+r.J.Path))
+	}
+
+	return nil
+}
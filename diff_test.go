@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+// A hard link whose target has gone still has the contents
+// it had.
+func TestDiffLinkTargetGone(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a", "contents of a")
+	j.Link("b", "a")
+	j.Backup()
+
+	// (Older backups recorded the target's deletion and
+	// left the link as it was.)
+	j.Remove("a")
+	seenDb, err := NewSeenDb(j.R.GetDbFilename(), plainEncrypt{}, j.nextEdition())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seenDb.Seen[j.Src("b")] = struct{}{}
+	err = seenDb.MarkDeleted(func(path string) bool {
+		return true
+	})
+
+	if err == nil {
+		err = seenDb.Close()
+	} else {
+		seenDb.Abort()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = j.R.DoDiff(new(Filters), "", plainEncrypt{})
+	if err != nil {
+		t.Errorf("Diff : %s", err.Error())
+	}
+
+	j.Write("b", "new contents of b")
+	err = j.R.DoDiff(new(Filters), "", plainEncrypt{})
+	if err == nil {
+		t.Errorf("Diff found nothing changed")
+	}
+}
@@ -0,0 +1,210 @@
+/* Exports editions without the encryption, so that they
+ * can be read with ordinary tools.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// With `merge', writes a single tar of the given edition
+// (or the latest, if nil) into `outDir'.  Otherwise,
+// decrypts the archive of the given edition (or every
+// archive, if nil) into a tar.gz (or whatever it was
+// compressed with) there.
+func (r *RunningJob) DoExport(filter Filter, repl Replacement, encrypt Encrypt, asOf *Edition, outDir string, merge bool) (err error) {
+	fmt.Printf("Running export %s...\n", r.J.BaseName)
+
+	archives, err := r.GetOldEditionFilenames()
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(archives)
+
+	if merge {
+		target := archives.FindAsOf(asOf)
+		if target < 0 {
+			return errors.New(fmt.Sprintf("%s : No editions to export", r.J.BaseName))
+		}
+
+		outName := filepath.Join(outDir, fmt.Sprintf("%s_%s.tar", filepath.Base(r.J.BaseName), archives.Names[target].E.String()))
+		return r.exportMerged(filter, repl, encrypt, asOf, outName)
+	}
+
+	exported := 0
+	for i := 0; i < archives.Len(); i++ {
+		if asOf != nil && archives.Names[i].E.Unix() != asOf.Unix() {
+			continue
+		}
+
+		leaf := strings.TrimSuffix(filepath.Base(archives.GetName(i)), ArchiveSuffix)
+		err = decryptArchive(archives.GetName(i), filepath.Join(outDir, leaf), encrypt)
+		if err != nil {
+			return err
+		}
+
+		exported += 1
+	}
+
+	if exported == 0 && asOf != nil {
+		return errors.New(fmt.Sprintf("%s : No archive for edition %s", r.J.BaseName, asOf.String()))
+	}
+
+	return nil
+}
+
+func (r *RunningJob) exportMerged(filter Filter, repl Replacement, encrypt Encrypt, asOf *Edition, outName string) (err error) {
+	fmt.Printf("Writing %s\n", outName)
+	f, err := os.Create(outName)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			os.Remove(outName)
+		}
+	}()
+
+	// Shared contents wait for their file's own header:
+	shared := make(map[string]*sharedEntry)
+	defer func() {
+		for _, entry := range shared {
+			os.Remove(entry.Spool)
+		}
+	}()
+
+	archTar := tar.NewWriter(f)
+	err = r.unpackEdition(filter, "", repl, encrypt, asOf, func(restoredPath string, hdr *tar.Header, reader io.Reader, isShared bool) error {
+		if isShared {
+			spool, _, err := spoolEntry(reader)
+			if err != nil {
+				return err
+			}
+
+			shared[restoredPath] = &sharedEntry{hdr, spool.Name()}
+			return spool.Close()
+		}
+
+		if isRefHeader(hdr) {
+			return copySharedEntry(archTar, restoredPath, clearRefHeader(hdr, 0), shared)
+		}
+
+		if isChunkedHeader(hdr) {
+			var err error
+			hdr, err = clearChunkedHeader(hdr)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr.Name = restoredPath
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name = fmt.Sprintf("%s%c", hdr.Name, os.PathSeparator)
+		}
+
+		return copyEntry(archTar, hdr, reader)
+	})
+
+	// Hard links whose targets we didn't export have no
+	// header of their own, but they're the same file as
+	// the one they share with anyway:
+	var leftOver []string
+	for restoredPath := range shared {
+		leftOver = append(leftOver, restoredPath)
+	}
+
+	sort.Strings(leftOver)
+	for i := 0; err == nil && i < len(leftOver); i++ {
+		err = copySharedEntry(archTar, leftOver[i], shared[leftOver[i]].Hdr, shared)
+	}
+
+	if err == nil {
+		err = archTar.Close()
+	}
+
+	return err
+}
+
+// Contents shared from another file, spooled until we
+// have the header of the file that shares them.
+type sharedEntry struct {
+	Hdr   *tar.Header
+	Spool string
+}
+
+// Writes out the shared contents that were spooled for a
+// file, with its own header.
+func copySharedEntry(archTar *tar.Writer, restoredPath string, hdr *tar.Header, shared map[string]*sharedEntry) error {
+	entry, found := shared[restoredPath]
+	if !found {
+		return errors.New(fmt.Sprintf("%s : Missing contents", restoredPath))
+	}
+
+	delete(shared, restoredPath)
+	defer os.Remove(entry.Spool)
+	spool, err := os.Open(entry.Spool)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	info, err := spool.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = restoredPath
+	hdr.Size = info.Size()
+	return copyEntry(archTar, hdr, spool)
+}
+
+// Writes out the plain contents of an archive, adding the
+// suffix for its compression to `outBase'.
+func decryptArchive(archive string, outBase string, encrypt Encrypt) (err error) {
+	archFile, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer archFile.Close()
+
+	archReader, err := encrypt.WrapReader(archFile)
+	if err != nil {
+		return err
+	}
+
+	archPlain := bufio.NewReader(archReader)
+	outName := outBase + compressionSuffix(sniffCompression(archPlain))
+	fmt.Printf("Decrypting %s to %s\n", archive, outName)
+	f, err := os.Create(outName)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, archPlain)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(outName)
+	}
+
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A file sharing another's contents is exported with its
+// own mode and mtime.
+func TestExportMergedShared(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	mtimes := []time.Time{
+		time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	j.Write("a", "contents")
+	j.Touch("a", mtimes[0])
+	j.Backup()
+
+	j.Write("b", "contents")
+	j.Touch("b", mtimes[1])
+	err := os.Chmod(j.Src("b"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.Backup()
+	out := filepath.Join(j.Dir, "export")
+	err = os.Mkdir(out, 0755)
+	if err == nil {
+		err = j.R.DoExport(new(Filters), new(Replacements), plainEncrypt{}, nil, out, true)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(out, "*.tar"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("Exported %v (%v)", names, err)
+	}
+
+	f, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tests := map[string]struct {
+		Mode  int64
+		Mtime time.Time
+	}{
+		j.Src("a"): {0644, mtimes[0]},
+		j.Src("b"): {0600, mtimes[1]},
+	}
+
+	found := 0
+	archTar := tar.NewReader(f)
+	for {
+		hdr, err := archTar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, ok := tests[hdr.Name]
+		if !ok {
+			continue
+		}
+
+		found += 1
+		contents, err := ioutil.ReadAll(archTar)
+		if err != nil || string(contents) != "contents" {
+			t.Errorf("%s : Exported %s (%v)", hdr.Name, contents, err)
+		}
+
+		if hdr.Mode != expected.Mode || !hdr.ModTime.Equal(expected.Mtime) || isRefHeader(hdr) {
+			t.Errorf("%s : Exported with mode %o, mtime %s", hdr.Name, hdr.Mode, hdr.ModTime)
+		}
+	}
+
+	if found != len(tests) {
+		t.Errorf("Exported %d files, expected %d", found, len(tests))
+	}
+}
@@ -0,0 +1,9 @@
+/* Keeping track of hard links. */
+
+package main
+
+// Identifies a file that has several hard links to it.
+type HardLinkId struct {
+	Device uint64
+	Inode  uint64
+}
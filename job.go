@@ -5,7 +5,6 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -14,12 +13,17 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	ArchiveSuffix  = ".tar.kblob"
 	DbSuffix       = "_seen.db.kblob"
+	TempSuffix     = ".partial"
+	CheckpointMins = 15
+	ReadRetries    = 3
 	Unpack_Test    = 0
 	Unpack_Restore = 1
 )
@@ -27,6 +31,9 @@ const (
 type RunningJob struct {
 	J Job
 	E *Edition
+
+	// The job file it came from.
+	JobPath string
 }
 
 func (r *RunningJob) GetDir() string {
@@ -41,6 +48,16 @@ func (r *RunningJob) GetNewEditionFilename() string {
 	return fmt.Sprintf("%s_%s%s", r.J.BaseName, r.E.String(), ArchiveSuffix)
 }
 
+// The new edition's archive is written in numbered
+// segments, which are joined together at the end.
+func (r *RunningJob) GetSegmentFilename(segment int) string {
+	return fmt.Sprintf("%s.%d%s", r.GetNewEditionFilename(), segment, TempSuffix)
+}
+
+func (r *RunningJob) GetCheckpointFilename() string {
+	return fmt.Sprintf("%s.checkpoint%s", r.GetDbFilename(), TempSuffix)
+}
+
 func (r *RunningJob) GetOldEditionFilenames() (names *ArchiveNames, err error) {
 	dir := r.GetDir()
 	infos, err := ioutil.ReadDir(dir)
@@ -74,7 +91,17 @@ func (r *RunningJob) GetNonSpecificExcludes() (names []string, err error) {
 			names = append(names, archiveNames.GetName(i))
 		}
 
-		names = append(names, r.GetNewEditionFilename(), r.GetDbFilename())
+		// (This one covers the files we're still writing.)
+		names = append(names, r.GetDbFilename(), filepath.Base(r.J.BaseName)+"_*"+TempSuffix)
+
+		// (And this one, copies of the database kept when
+		// upgrading it.)
+		names = append(names, filepath.Base(r.GetDbFilename())+".schema*")
+
+		// (There's no new edition if we aren't backing up.)
+		if r.E != nil {
+			names = append(names, r.GetNewEditionFilename())
+		}
 	}
 
 	return names, err
@@ -96,48 +123,173 @@ func getHash(filename string) (hashBytes []byte, err error) {
 	return h.Sum(hashBytes), nil
 }
 
-func copyInto(filename string, writer io.Writer) error {
+// Copies exactly `size' bytes of a file, which might not be
+// all of it (or might need padding out with zeroes) if it
+// has changed since we looked.
+func copyInto(filename string, writer io.Writer, size int64) error {
 	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = io.Copy(writer, f)
+	return copyExactly(writer, f, size)
+}
+
+// Copies `size' bytes, padding them out with zeroes if the
+// reader runs out first.
+func copyExactly(writer io.Writer, reader io.Reader, size int64) error {
+	copied, err := io.CopyN(writer, reader, size)
+	if err == io.EOF {
+		_, err = io.CopyN(writer, zeroReader{}, size-copied)
+	}
+
 	return err
 }
 
-func copyOutOf(filename string, reader io.Reader) error {
+// Tests whether a path is the given root or somewhere
+// underneath it.
+func isUnder(path string, root string) bool {
+	if path == root {
+		return true
+	}
+
+	if !strings.HasSuffix(root, string(os.PathSeparator)) {
+		root = fmt.Sprintf("%s%c", root, os.PathSeparator)
+	}
+
+	return strings.HasPrefix(path, root)
+}
+
+// Compares two paths in the order that filepath.Walk
+// visits them, which sorts each directory's names (so that
+// "a/b" comes before "a.b", unlike in a string compare).
+func compareWalkOrder(a string, b string) int {
+	as := strings.Split(a, string(os.PathSeparator))
+	bs := strings.Split(b, string(os.PathSeparator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+
+	return len(as) - len(bs)
+}
+
+// If `sparse' is set, blocks of zeros become holes.
+func copyOutOf(filename string, reader io.Reader, sparse bool) error {
+	// Older archives might not contain the directory
+	// that this file belongs in any more:
+	err := os.MkdirAll(filepath.Dir(filename), 0777)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, reader)
+	if !sparse {
+		_, err = io.Copy(f, reader)
+		return err
+	}
+
+	w := &sparseWriter{f, 0}
+	_, err = io.Copy(w, reader)
+	if err == nil {
+		err = w.Finish()
+	}
+
 	return err
 }
 
-func (r *RunningJob) DoBackup(filter *Filters, prefix string, encrypt Encrypt, removeAfterEdition *Edition) (err error) {
+func (r *RunningJob) DoBackup(filter *Filters, prefix string, encrypt Encrypt, compress Compressor, removeAfterEdition *Edition, resume bool) (err error) {
 	// TODO Proper log file and summary on stdout
 	fmt.Printf("Running backup %s ...\n", r.J.BaseName)
 
-	// Construct the full filter (out of the general ones
-	// and the specific ones to this job)
-	fullFilter := filter.WithExcludes(r.J.Excludes)
-
-	// If we have an include filter, add the root path of
-	// the job to it, otherwise everything will be
-	// excluded and that would be bad :)
-	fullFilter.AddIncludeToExisting(r.J.Path)
-
-	// Open up the database:
-	fmt.Printf("Opening database %s\n", r.GetDbFilename())
-	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, r.E)
+	stats := &EditionStats{Start: time.Now(), JobPath: r.JobPath, Prefix: prefix}
+	fullFilter := r.getFullFilter(filter)
+	store, err := NewStoreFilter(r.J.Uncompressed)
 	if err != nil {
 		return err
 	}
-	defer seenDb.Close()
+
+	if _, isXz := compress.(*CompressXz); isXz && (len(store.Extensions) > 0 || len(store.Formats) > 0) {
+		fmt.Printf("%s : xz can't store files without compressing them, so files that are compressed already get compressed again\n", r.J.BaseName)
+	}
+
+	changeDetection := r.J.ChangeDetection
+	switch changeDetection {
+	case "":
+		changeDetection = Detect_Mtime
+
+	case Detect_Mtime, Detect_Metadata, Detect_Always:
+
+	default:
+		return errors.New(fmt.Sprintf("Unknown change detection %s", changeDetection))
+	}
+
+	var seenDb *SeenDb
+	segments := 0
+	resumeAfter := ""
+	if resume {
+		// Carry on from the last checkpoint, if there is one,
+		// or else back up as usual:
+		if _, statErr := os.Stat(r.GetCheckpointFilename()); statErr != nil {
+			fmt.Printf("%s : Nothing to resume; starting a new backup\n", r.J.BaseName)
+			resume = false
+		}
+	}
+
+	if resume {
+		fmt.Printf("Opening checkpoint %s\n", r.GetCheckpointFilename())
+		seenDb, segments, resumeAfter, err = NewSeenDbFromCheckpoint(r.GetCheckpointFilename(), r.GetDbFilename(), encrypt)
+		if err != nil {
+			return err
+		}
+
+		r.E = seenDb.E
+		fmt.Printf("Resuming edition %s after %d segments\n", r.E.String(), segments)
+
+		// Anything written after the checkpoint is lost:
+		err = r.removeSegments(segments)
+		if err != nil {
+			seenDb.Abort()
+			return err
+		}
+	} else {
+		// Clear up after any backup that didn't finish:
+		err = r.RemoveLeftovers()
+		if err != nil {
+			return err
+		}
+
+		// Open up the database:
+		fmt.Printf("Opening database %s\n", r.GetDbFilename())
+		seenDb, err = NewSeenDb(r.GetDbFilename(), encrypt, r.E)
+		if err != nil {
+			return err
+		}
+
+		seenDb.KeepUpgrade()
+	}
+
+	seenDb.ChangeDetection = changeDetection
+
+	// We only keep the changes to the database if the
+	// whole edition made it, and vice versa.  Once it has,
+	// there's nothing left to resume:
+	defer func() {
+		if err != nil {
+			seenDb.Abort()
+		} else if err = seenDb.Close(); err != nil {
+			os.Remove(r.GetNewEditionFilename())
+		} else if err = r.removeSegments(0); err == nil {
+			os.Remove(r.GetCheckpointFilename())
+		}
+	}()
 
 	// If applicable, remove later editions:
 	if removeAfterEdition != nil {
@@ -162,35 +314,301 @@ func (r *RunningJob) DoBackup(filter *Filters, prefix string, encrypt Encrypt, r
 		}
 	}
 
-	// Open up the new archive:
-	fmt.Printf("Opening new archive %s\n", r.GetNewEditionFilename())
-	archFile, err := os.Create(r.GetNewEditionFilename())
+	interval := time.Duration(r.J.CheckpointMinutes) * time.Minute
+	if interval <= 0 {
+		interval = CheckpointMins * time.Minute
+	}
+
+	// Write the new archive in segments, checkpointing the
+	// database after each one:
+	segments += 1
+	fmt.Printf("Opening new archive %s\n", r.GetSegmentFilename(segments))
+	archive, err := NewArchiveWriter(r.GetSegmentFilename(segments), encrypt, compress)
 	if err != nil {
 		return err
 	}
-	defer archFile.Close()
 
-	archPlain, err := encrypt.WrapWriter(archFile)
-	if err != nil {
+	defer func() {
+		if archive != nil {
+			archive.Abort()
+		}
+	}()
+
+	lastCheckpoint := time.Now()
+	checkpoint := func(lastPath string) error {
+		err := archive.Close(true)
+		archive = nil
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Checkpointing after %d segments\n", segments)
+		err = seenDb.Checkpoint(r.GetCheckpointFilename(), segments, lastPath)
+		if err != nil {
+			return err
+		}
+
+		lastCheckpoint = time.Now()
+		segments += 1
+		archive, err = NewArchiveWriter(r.GetSegmentFilename(segments), encrypt, compress)
 		return err
 	}
-	defer archPlain.Close()
 
-	archGz := gzip.NewWriter(archPlain)
-	defer archGz.Close()
+	// The first path we saw for each file with several
+	// hard links; the others get linked to it:
+	links := make(map[HardLinkId]string)
 
-	archTar := tar.NewWriter(archGz)
-	defer archTar.Close()
+	// Archives one file that the walk found, now that the
+	// work on it that could be done ahead of time is done:
+	include := func(item *pipelineItem) error {
+		defer item.Discard()
+		prefixedPath, path, info := item.PrefixedPath, item.Path, item.Info
+
+		// Work out whether to include it in the archive.
+		mode := info.Mode()
+		if (mode & os.ModeTemporary) != 0 {
+			fmt.Printf("%s : Skipping temporary file\n", path)
+		} else if (mode&os.ModeDevice) != 0 && !r.J.SpecialFiles {
+			fmt.Printf("%s : Skipping device file\n", path)
+		} else if (mode&os.ModeNamedPipe) != 0 && !r.J.SpecialFiles {
+			fmt.Printf("%s : Skipping pipe file\n", path)
+		} else if (mode & os.ModeSocket) != 0 {
+			// (tar has no way of storing these.)
+			fmt.Printf("%s : Skipping socket file\n", path)
+		} else if (mode & os.ModeType) == 0 {
+			// This is a regular file; look it up against
+			// the database
+			stats.Scanned += 1
+			var err error
+			id, linked := GetHardLinkId(info)
+			if target, found := links[id]; linked && found {
+				err = seenDb.UpdateLink(path, GetFileMeta(info), target, func() error {
+					return r.backupLink(path, target, info, archive.Tar)
+				})
+			} else {
+				// We read the file just the once (unless
+				// it's too big to keep), and archive what
+				// we hashed:
+				var read *FileRead
+				err = seenDb.Update(path, GetFileMeta(info), func(stream bool) (*FileRead, error) {
+					if !item.Read {
+						r.readFile(item, compress, store, seenDb, archive, stream)
+					}
+
+					stats.BytesRead += item.BytesRead
+					// (If it changed, we read it again.)
+					read = &FileRead{item.Hash, GetFileMeta(item.Info), item.Archived, item.Unstable}
+					return read, item.ReadErr
+				}, func() error {
+					bytesRead := item.BytesRead
+					err := r.includeFile(item, seenDb, archive)
+					stats.BytesRead += item.BytesRead - bytesRead
+					read.Hash, read.Unstable = item.Hash, item.Unstable
+					return err
+				}, func(ref string, refEdition *Edition) error {
+					return r.backupRef(prefixedPath, path, ref, refEdition, item.Info, archive.Tar)
+				})
+
+				if err == nil && linked {
+					links[id] = path
+				}
+
+				// If it wouldn't keep still, we archived
+				// the last version we read (and flagged it),
+				// but it might not be consistent:
+				if err == nil && item.Unstable {
+					fmt.Printf("%s : Changed while being archived\n", path)
+					stats.Unstable += 1
+				}
+			}
+
+			if err != nil {
+				// Report errors and continue, to do a best-effort backup.
+				fmt.Printf("%s : %s\n", path, err.Error())
+				stats.Failed += 1
+			}
+		} else if resumeAfter != "" && compareWalkOrder(path, resumeAfter) <= 0 {
+			// The segments from before the checkpoint we
+			// resumed from have this already.
+		} else {
+			// This is something like a directory, or a
+			// device file.
+			// It doesn't go in the database, but it does
+			// go in the tar file:
+			err := r.backupFile(prefixedPath, path, info, mode, archive, nil)
+			if err != nil {
+				fmt.Printf("%s : %s\n", path, err.Error())
+				stats.Failed += 1
+			}
+		}
+
+		if time.Since(lastCheckpoint) >= interval {
+			return checkpoint(path)
+		}
+
+		return nil
+	}
+
+	pipeline := newBackupPipeline(r.J.Workers)
+	defer pipeline.Abort()
 
 	// Now we can walk the tree scooping everything.
-	// We include the prefix only onto the source files
-	// that we read from, and drop it everywhere else,
-	// so that it is "invisible" in the final backup.
-	// TODO: How to avoid transitioning across filesystems?
-	err = filepath.Walk(prefix+r.J.Path, func(prefixedPath string, info os.FileInfo, walkErr error) error {
+	unreadable, skipped, err := r.walkTree(fullFilter, prefix, func(prefixedPath string, path string, info os.FileInfo) error {
+		item := &pipelineItem{PrefixedPath: prefixedPath, Path: path, Info: info}
+		pipeline.Add(item, r.planWork(seenDb, item, compress, store))
+		for next := pipeline.Next(false); next != nil; next = pipeline.Next(false) {
+			err := include(next)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	for err == nil {
+		next := pipeline.Next(true)
+		if next == nil {
+			break
+		}
+
+		err = include(next)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if stats.Unstable > 0 {
+		fmt.Printf("%s : %d files changed while being archived\n", r.J.BaseName, stats.Unstable)
+	}
+
+	// Record the deletion of everything we expected to
+	// see and didn't:
+	err = seenDb.MarkDeleted(r.getMightBeDeleted(fullFilter, unreadable, skipped))
+	if err != nil {
+		return err
+	}
+
+	err = archive.Close(false)
+	archive = nil
+	if err != nil {
+		return err
+	}
+
+	// Put the segments together.  The new archive only
+	// appears under its real name once it's complete:
+	if segments == 1 {
+		err = os.Rename(r.GetSegmentFilename(1), r.GetNewEditionFilename())
+	} else {
+		fmt.Printf("Joining %d segments into %s\n", segments, r.GetNewEditionFilename())
+		var segmentNames []string
+		for i := 1; i <= segments; i++ {
+			segmentNames = append(segmentNames, r.GetSegmentFilename(i))
+		}
+
+		err = joinArchives(segmentNames, r.GetNewEditionFilename(), encrypt)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Record what we did:
+	newInfo, err := os.Stat(r.GetNewEditionFilename())
+	if err != nil {
+		return err
+	}
+
+	stats.End = time.Now()
+	stats.Hostname, _ = os.Hostname()
+	stats.Added = seenDb.Added
+	// (Other filesystems that we skipped aren't failures.)
+	stats.Failed += int64(len(unreadable))
+	stats.BytesStored = newInfo.Size()
+	return seenDb.RecordEdition(stats)
+}
+
+// Removes the new edition's archive segments after the
+// given one, and any that were never completed.
+func (r *RunningJob) removeSegments(keep int) error {
+	segmentNames, err := filepath.Glob(r.GetNewEditionFilename() + ".*" + TempSuffix)
+	if err != nil {
+		return err
+	}
+
+	prefix := r.GetNewEditionFilename() + "."
+	for i := 0; i < len(segmentNames); i++ {
+		segment, convErr := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(segmentNames[i], prefix), TempSuffix))
+		if convErr != nil || segment > keep {
+			err = os.Remove(segmentNames[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Removes any temporary files left behind by a backup
+// or prune that didn't finish.
+func (r *RunningJob) RemoveLeftovers() error {
+	dir := r.GetDir()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	prefix := filepath.Base(r.J.BaseName) + "_"
+	for i := 0; i < len(infos); i++ {
+		filename := infos[i].Name()
+		if (infos[i].Mode()&os.ModeType) == 0 && strings.HasPrefix(filename, prefix) && strings.HasSuffix(filename, TempSuffix) {
+			fmt.Printf("Removing leftover %s\n", filename)
+			err = os.Remove(filepath.Join(dir, filename))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Constructs the full filter (out of the general ones
+// and the specific ones to this job)
+func (r *RunningJob) getFullFilter(filter *Filters) *Filters {
+	fullFilter := filter.WithExcludes(r.J.Excludes)
+
+	// If we have an include filter, add the root path of
+	// the job to it, otherwise everything will be
+	// excluded and that would be bad :)
+	fullFilter.AddIncludeToExisting(r.J.Path)
+	return fullFilter
+}
+
+// Walks the job's tree, calling the function with each
+// (prefixed path, path, info) that the filter includes.
+// We include the prefix only onto the source files
+// that we read from, and drop it everywhere else,
+// so that it is "invisible" in the final backup.
+// Returns the paths that we failed to read, and those we
+// didn't look at because they're on another filesystem.
+func (r *RunningJob) walkTree(fullFilter *Filters, prefix string, visit func(string, string, os.FileInfo) error) (unreadable []string, skipped []string, err error) {
+	// The filesystems we're allowed onto, if we're
+	// staying on the one the root is on:
+	devices := make(map[uint64]struct{})
+	crossMounts := make(map[string]struct{})
+	for i := 0; i < len(r.J.CrossMounts); i++ {
+		crossMounts[filepath.Clean(r.J.CrossMounts[i])] = struct{}{}
+	}
+
+	root := prefix + r.J.Path
+	err = filepath.Walk(root, func(prefixedPath string, info os.FileInfo, walkErr error) error {
 
 		getIgnoreValue := func() error {
-			if info.IsDir() {
+			// (We get no info if the root itself is missing.)
+			if info != nil && info.IsDir() {
 				return filepath.SkipDir
 			} else {
 				return nil
@@ -205,6 +623,7 @@ func (r *RunningJob) DoBackup(filter *Filters, prefix string, encrypt Encrypt, r
 		// ignore it:
 		if walkErr != nil {
 			fmt.Printf("%s : %s\n", path, walkErr.Error())
+			unreadable = append(unreadable, path)
 			return getIgnoreValue()
 		}
 
@@ -215,49 +634,72 @@ func (r *RunningJob) DoBackup(filter *Filters, prefix string, encrypt Encrypt, r
 			return getIgnoreValue()
 		}
 
-		// Work out whether to include it in the archive.
-		mode := info.Mode()
-		if (mode & os.ModeTemporary) != 0 {
-			fmt.Printf("%s : Skipping temporary file\n", path)
-		} else if (mode & os.ModeDevice) != 0 {
-			fmt.Printf("%s : Skipping device file\n", path)
-		} else if (mode & os.ModeNamedPipe) != 0 {
-			fmt.Printf("%s : Skipping pipe file\n", path)
-		} else if (mode & os.ModeSocket) != 0 {
-			fmt.Printf("%s : Skipping socket file\n", path)
-		} else if (mode & os.ModeType) == 0 {
-			// This is a regular file; look it up against
-			// the database
-			err = seenDb.Update(path, info.ModTime(), func() ([]byte, error) {
-				return getHash(prefixedPath)
-			}, func() (err error) {
-				return r.backupFile(prefixedPath, path, info, mode, archTar)
-			})
+		if !r.J.OneFileSystem {
+			return visit(prefixedPath, path, info)
+		}
 
-			if err != nil {
-				// Report errors and continue, to do a best-effort backup.
-				fmt.Printf("%s : %s\n", path, err.Error())
-			}
-		} else {
-			// This is something like a directory.
-			// It doesn't go in the database, but it does
-			// go in the tar file:
-			err = r.backupFile(prefixedPath, path, info, mode, archTar)
-			if err != nil {
-				fmt.Printf("%s : %s\n", path, err.Error())
-			}
+		device, found := GetDeviceId(info)
+		if !found {
+			return visit(prefixedPath, path, info)
 		}
 
-		return nil
+		if _, allowed := devices[device]; allowed {
+			return visit(prefixedPath, path, info)
+		}
+
+		_, cross := crossMounts[filepath.Clean(path)]
+		if prefixedPath == root || cross {
+			devices[device] = struct{}{}
+			return visit(prefixedPath, path, info)
+		}
+
+		// This is somewhere another filesystem is mounted.
+		// We keep the mount point itself, but not what's on
+		// it (which might well still exist, of course):
+		fmt.Printf("%s : Skipping other filesystem\n", path)
+		skipped = append(skipped, path)
+		if !info.IsDir() {
+			return nil
+		}
+
+		err := visit(prefixedPath, path, info)
+		if err != nil {
+			return err
+		}
+
+		return filepath.SkipDir
 	})
 
-	// TODO : Search the db for files that no longer
-	// exist and blank entries?
+	return unreadable, skipped, err
+}
 
-	return err
+// Makes a function telling whether a file we didn't see
+// in the walk might have been deleted.  Files that are
+// excluded, or that are somewhere we couldn't read or
+// skipped, may well still exist.
+func (r *RunningJob) getMightBeDeleted(fullFilter *Filters, unreadable []string, skipped []string) func(string) bool {
+	notLooked := append(append([]string(nil), unreadable...), skipped...)
+	return func(path string) bool {
+		if !isUnder(path, r.J.Path) || !fullFilter.Include(path) {
+			return false
+		}
+
+		for i := 0; i < len(notLooked); i++ {
+			if isUnder(path, notLooked[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
 }
 
-func (r *RunningJob) backupFile(prefixedPath string, path string, info os.FileInfo, mode os.FileMode, archTar *tar.Writer) (err error) {
+// A regular file's contents go to `h' as well (if it isn't
+// nil), exactly as they are archived.
+func (r *RunningJob) backupFile(prefixedPath string, path string, info os.FileInfo, mode os.FileMode, archive *ArchiveWriter, h io.Writer) (err error) {
+	if h == nil {
+		h = ioutil.Discard
+	}
 
 	// If it's a symlink, read the link target:
 	link := ""
@@ -283,23 +725,41 @@ func (r *RunningJob) backupFile(prefixedPath string, path string, info os.FileIn
 
 	hdr.Name = tarPath
 
-	// ...and the uid and gid;
+	// ...and the uid and gid, and extended attributes;
 	// this is platform specific
 	AssignUserIds(info, hdr)
+	err = AssignXattrs(prefixedPath, info, hdr)
+	if err != nil {
+		return
+	}
 
 	// ...and the modification time.
 	// Note that it looks like the AccessTime field doesn't work,
 	// so I'm ignoring it
 	hdr.ModTime = info.ModTime()
 
-	err = archTar.WriteHeader(hdr)
+	// If it's a sparse file, we only want the parts with
+	// data in:
+	if (mode & os.ModeType) == 0 {
+		var data []SparseEntry
+		data, err = GetSparseData(prefixedPath, info)
+		if err != nil {
+			return
+		}
+
+		if data != nil {
+			return writeSparseFile(archive, hdr, prefixedPath, data, h)
+		}
+	}
+
+	err = archive.Tar.WriteHeader(hdr)
 	if err != nil {
 		return
 	}
 
 	// If this is a real file, write the contents:
 	if (mode & os.ModeType) == 0 {
-		err = copyInto(prefixedPath, archTar)
+		err = copyInto(prefixedPath, io.MultiWriter(archive.Tar, h), hdr.Size)
 		if err != nil {
 			return
 		}
@@ -308,37 +768,162 @@ func (r *RunningJob) backupFile(prefixedPath string, path string, info os.FileIn
 	return
 }
 
-func (r *RunningJob) DoListEditions(encrypt Encrypt) error {
+// Writes a hard link to a file that's already been
+// backed up.
+func (r *RunningJob) backupLink(path string, target string, info os.FileInfo, archTar *tar.Writer) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Typeflag = tar.TypeLink
+	hdr.Name = path
+	hdr.Linkname = target
+	hdr.Size = 0
+	AssignUserIds(info, hdr)
+	hdr.ModTime = info.ModTime()
+
+	return archTar.WriteHeader(hdr)
+}
+
+// Writes a file whose contents are already archived
+// elsewhere, as a reference to them.
+func (r *RunningJob) backupRef(prefixedPath string, path string, ref string, refEdition *Edition, info os.FileInfo, archTar *tar.Writer) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = path
+	hdr.Size = 0
+	AssignUserIds(info, hdr)
+	err = AssignXattrs(prefixedPath, info, hdr)
+	if err != nil {
+		return err
+	}
+
+	hdr.ModTime = info.ModTime()
+	setRefHeader(hdr, ref, refEdition)
+	return archTar.WriteHeader(hdr)
+}
+
+func (r *RunningJob) DoListEditions(encrypt Encrypt) (err error) {
 	// Open up the database:
 	fmt.Printf("Opening database %s\n", r.GetDbFilename())
 	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, r.E)
 	if err != nil {
 		return err
 	}
-	defer seenDb.Close()
+	defer closeReadOnly(seenDb, &err)
 
 	// Get the editions:
-	var editions *SortedEditions
-	editions, err = seenDb.ListEditions()
+	list, err := seenDb.ListEditionStats()
 	if err != nil {
 		return err
 	}
 
-	for i := 0; i < editions.Len(); i++ {
-		fmt.Printf("%s : %s\n", r.J.BaseName, editions.At(i).String())
+	for i := 0; i < len(list); i++ {
+		if list[i].End.IsZero() {
+			fmt.Printf("%s : %s\n", r.J.BaseName, list[i].E.String())
+		} else {
+			fmt.Printf("%s : %s : %d added, %d failed, %d bytes stored\n", r.J.BaseName, list[i].E.String(), list[i].Added, list[i].Failed, list[i].BytesStored)
+		}
 	}
 
 	return nil
 }
 
+func (r *RunningJob) DoStats(encrypt Encrypt) (err error) {
+	fmt.Printf("Opening database %s\n", r.GetDbFilename())
+	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, r.E)
+	if err != nil {
+		return err
+	}
+	defer closeReadOnly(seenDb, &err)
+
+	list, err := seenDb.ListEditionStats()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(list); i++ {
+		stats := list[i]
+		fmt.Printf("%s : %s\n", r.J.BaseName, stats.E.String())
+		if stats.IsRebuilt() {
+			fmt.Printf("  Rebuilt from its archive: %d files, %d bytes stored\n", stats.Added, stats.BytesStored)
+			continue
+		} else if stats.End.IsZero() {
+			fmt.Printf("  No statistics recorded\n")
+			continue
+		}
+
+		fmt.Printf("  Ran from %s to %s (%s) on %s\n", stats.Start.Format(time.RFC3339), stats.End.Format(time.RFC3339), stats.End.Sub(stats.Start).Round(time.Millisecond), stats.Hostname)
+		fmt.Printf("  Job %s, prefix \"%s\"\n", stats.JobPath, stats.Prefix)
+		fmt.Printf("  %d files scanned, %d added, %d failed, %d unstable\n", stats.Scanned, stats.Added, stats.Failed, stats.Unstable)
+		fmt.Printf("  %d bytes read, %d bytes stored\n", stats.BytesRead, stats.BytesStored)
+	}
+
+	return nil
+}
+
+// `asOf' is the edition to unpack, or nil for the latest.
 // `what' should be one of: Unpack_Test, Unpack_Restore
-func (r *RunningJob) DoUnpack(filter Filter, prefix string, repl Replacement, encrypt Encrypt, what int) (err error) {
+// `skipXattrs' lists extended attribute namespaces (or
+// names) not to restore.
+func (r *RunningJob) DoUnpack(filter Filter, prefix string, repl Replacement, encrypt Encrypt, asOf *Edition, what int, skipXattrs []string) (err error) {
 	// TODO Again, proper log file and summary on stdout
+	if what == Unpack_Test {
+		fmt.Printf("Running test %s...\n", r.J.BaseName)
+		return r.DoVerify(filter, prefix, repl, encrypt, asOf)
+	}
+
 	fmt.Printf("Running restore %s...\n", r.J.BaseName)
+	return r.unpackEdition(filter, prefix, repl, encrypt, asOf, func(restoredPath string, hdr *tar.Header, archTar io.Reader, shared bool) error {
+		return restoreFile(restoredPath, hdr, archTar, skipXattrs)
+	})
+}
+
+// Finds the archive entry holding a file's contents as of
+// the given edition, following references and hard links,
+// or nil if there isn't one.
+func findContentHolder(seenDb Seen, filename string, asOf *Edition) (*fileEdition, error) {
+	// (A link to a link to a link... is possible, but
+	// not a loop.)
+	for {
+		entry, err := seenDb.GetLatest(filename, asOf)
+		if err != nil || entry == nil || entry.IsDeleted() {
+			return nil, err
+		}
 
-	// For now, we will simply unpack everything in order.
-	// TODO : Cross reference with the database, avoid
-	// unpacking old stuff?  (Allows delete?)
+		if entry.Ref != "" {
+			return &fileEdition{entry.Ref, entry.RefE.Unix()}, nil
+		}
+
+		if entry.Link == "" {
+			return &fileEdition{filename, entry.E.Unix()}, nil
+		}
+
+		filename, asOf = entry.Link, entry.E
+	}
+}
+
+// Calls the unpack function for each file in the given
+// edition (or the latest, if nil).  It's told whether the
+// contents are shared from another file (whose header it
+// gets, but named after this one); a file sharing another
+// file's contents gets its own header too, afterwards.
+func (r *RunningJob) unpackEdition(filter Filter, prefix string, repl Replacement, encrypt Encrypt, asOf *Edition, unpackFile func(string, *tar.Header, io.Reader, bool) error) (err error) {
+	// Open up the database, which knows about deletions:
+	fmt.Printf("Opening database %s\n", r.GetDbFilename())
+	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, r.E)
+	if err != nil {
+		return err
+	}
+	defer closeReadOnly(seenDb, &err)
+
+	// We unpack archives in order, writing each file only
+	// from the edition that holds its final version, and
+	// skipping files that were deleted by the chosen edition.
 	archives, err := r.GetOldEditionFilenames()
 	if err != nil {
 		return err
@@ -346,74 +931,289 @@ func (r *RunningJob) DoUnpack(filter Filter, prefix string, repl Replacement, en
 
 	sort.Sort(archives)
 
-	var unpackFile func(string, *tar.Header, io.Reader) error
-	if what == Unpack_Test {
-		unpackFile = testFile
-	} else if what == Unpack_Restore {
-		unpackFile = restoreFile
+	// The target archive is the last one up to the chosen
+	// edition; it holds all the directories etc.
+	target := archives.FindAsOf(asOf)
+	if target < 0 && asOf != nil {
+		return errors.New(fmt.Sprintf("No editions at or before %s", asOf.String()))
 	}
 
-	for i := 0; i < archives.Len(); i++ {
-		err = unpackArchive(archives.GetName(i), filter, prefix, repl, encrypt, unpackFile)
+	// An edition rebuilt from its archive doesn't know
+	// which files had been deleted by then:
+	if target >= 0 {
+		var list []*EditionStats
+		list, err = seenDb.ListEditionStats()
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
-}
+		for i := 0; i < len(list); i++ {
+			if list[i].E.Unix() != archives.Names[target].E.Unix() || !list[i].IsRebuilt() {
+				continue
+			}
 
-func unpackArchive(archive string, filter Filter, prefix string, repl Replacement, encrypt Encrypt, unpackFile func(string, *tar.Header, io.Reader) error) (err error) {
-	fmt.Printf("Restoring %s...\n", archive)
+			if asOf != nil {
+				return errors.New(fmt.Sprintf("%s : Rebuilt from its archive, so deleted files can't be told apart; restore the latest edition instead", list[i].E.String()))
+			}
 
-	if len(prefix) > 0 {
-		err = os.MkdirAll(prefix, 0777)
-		if err != nil {
-			return err
+			fmt.Printf("%s : Rebuilt from its archive, so files deleted before it might come back\n", list[i].E.String())
 		}
 	}
 
-	archFile, err := os.Open(archive)
+	// Other than that, we only need the archives holding
+	// files that were live at that point:
+	needed, err := seenDb.ListNeededEditions(asOf)
 	if err != nil {
 		return err
 	}
-	defer archFile.Close()
 
-	archPlain, err := encrypt.WrapReader(archFile)
+	neededUnix := make(map[int64]struct{})
+	for i := 0; i < needed.Len(); i++ {
+		neededUnix[needed.At(i).Unix()] = struct{}{}
+	}
+
+	// Hard links can only be made once we have their
+	// targets, which might be in a later archive:
+	var links []*tar.Header
+
+	// Likewise, files stored in chunks, and files sharing
+	// the contents of another, are only complete once
+	// we've seen every archive:
+	var later []*tar.Header
+	chunks, err := newChunkSpool(seenDb, asOf, filter)
 	if err != nil {
 		return err
 	}
+	defer chunks.Close()
+
+	// Files that share the contents of another file get
+	// them from that file's archive entry:
+	refs := make(map[fileEdition][]string)
+	linkEntries := make(map[string]*SeenEntry)
+	err = seenDb.ListLatest(asOf, func(filename string, entry *SeenEntry) error {
+		if !entry.IsDeleted() && entry.Ref != "" && filter.Include(filename) {
+			key := fileEdition{entry.Ref, entry.RefE.Unix()}
+			refs[key] = append(refs[key], filename)
+		} else if !entry.IsDeleted() && entry.Link != "" && filter.Include(filename) {
+			linkEntries[filename] = entry
+		}
+
+		return nil
+	})
 
-	archGz, err := gzip.NewReader(archPlain)
 	if err != nil {
 		return err
 	}
-	defer archGz.Close()
 
-	archTar := tar.NewReader(archGz)
+	// So do hard links whose targets we aren't restoring
+	// (because they've been deleted since, say):
+	unlinked := make(map[string]struct{})
+	for filename, entry := range linkEntries {
+		var target *SeenEntry
+		target, err = seenDb.GetLatest(entry.Link, asOf)
+		if err != nil {
+			return err
+		}
+
+		if target != nil && !target.IsDeleted() && filter.Include(entry.Link) {
+			continue
+		}
+
+		var holder *fileEdition
+		holder, err = findContentHolder(seenDb, entry.Link, entry.E)
+		if err != nil {
+			return err
+		}
+
+		if holder == nil {
+			fmt.Printf("%s : Missing contents of link target %s\n", filename, entry.Link)
+			continue
+		}
+
+		unlinked[filename] = struct{}{}
+		refs[*holder] = append(refs[*holder], filename)
+		neededUnix[holder.Edition] = struct{}{}
+	}
+
+	for i := 0; i <= target; i++ {
+		// (If the database doesn't know about any files at
+		// all, we have no choice but to look at everything.)
+		if _, found := neededUnix[archives.Names[i].E.Unix()]; !found && i != target && needed.Len() > 0 {
+			continue
+		}
+
+		// Every edition contains all the directories,
+		// symlinks etc, so we only take those from the
+		// target one; otherwise we would bring back ones
+		// that had been removed.
+		latest := i == target
+		archiveEdition := archives.Names[i].E
+		err = unpackArchive(archives.GetName(i), func(hdr *tar.Header, reader io.Reader) ([]string, error) {
+			if isChunkEntry(hdr) {
+				return nil, chunks.Add(hdr, reader)
+			}
+
+			shared := refs[fileEdition{hdr.Name, archiveEdition.Unix()}]
+			if !filter.Include(hdr.Name) {
+				return shared, nil
+			}
+
+			if (hdr.FileInfo().Mode() & os.ModeType) != 0 {
+				if latest {
+					return []string{hdr.Name}, nil
+				}
+
+				return nil, nil
+			}
+
+			entry, err := seenDb.GetLatest(hdr.Name, asOf)
+			if err != nil {
+				return nil, err
+			}
+
+			// If the database has never heard of this file,
+			// all we can do is restore every copy in order.
+			includeFile := entry == nil || (!entry.IsDeleted() && entry.E.Unix() == archiveEdition.Unix())
+			if includeFile && hdr.Typeflag == tar.TypeLink {
+				if _, found := unlinked[hdr.Name]; !found {
+					links = append(links, hdr)
+				}
+
+				return shared, nil
+			}
+
+			if includeFile && isChunkedHeader(hdr) {
+				later = append(later, hdr)
+				return shared, chunks.AddHeader(hdr)
+			}
+
+			if includeFile && isRefHeader(hdr) {
+				later = append(later, hdr)
+				return shared, nil
+			}
+
+			if includeFile {
+				return append([]string{hdr.Name}, shared...), nil
+			}
+
+			return shared, nil
+		}, prefix, repl, encrypt, unpackFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The chunks of a file that the database doesn't list
+	// come before its header, so we go back for them:
+	if chunks.Missing() {
+		for i := 0; i <= target; i++ {
+			fmt.Printf("Reading %s for chunks...\n", archives.GetName(i))
+			err = readArchive(archives.GetName(i), encrypt, func(hdr *tar.Header, reader io.Reader) error {
+				if isChunkEntry(hdr) {
+					return chunks.Add(hdr, reader)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	errorCount := 0
-	var readErr error
-	for readErr == nil {
-		includeFile := false
-
-		var hdr *tar.Header
-		hdr, readErr = archTar.Next()
-		if readErr != nil && readErr != io.EOF {
-			return readErr
-		} else if readErr == nil {
-			includeFile = filter.Include(hdr.Name)
-		}
-
-		if includeFile {
-			replacedPath := repl.Replace(hdr.Name)
-			restoredPath := filepath.Join(prefix, replacedPath)
-			restoreErr := unpackFile(restoredPath, hdr, archTar)
+	for i := 0; i < len(later); i++ {
+		restoredPath := filepath.Join(prefix, repl.Replace(later[i].Name))
+		var reader io.Reader = strings.NewReader("")
+		var laterErr error
+		if isChunkedHeader(later[i]) {
+			reader, laterErr = chunks.Reader(later[i])
+		}
+
+		if laterErr == nil {
+			laterErr = unpackFile(restoredPath, later[i], reader, false)
+		}
+
+		if laterErr != nil {
+			fmt.Printf("%s : %s\n", restoredPath, laterErr.Error())
+			errorCount += 1
+		}
+	}
+
+	for i := 0; i < len(links); i++ {
+		restoredPath := filepath.Join(prefix, repl.Replace(links[i].Name))
+		links[i].Linkname = filepath.Join(prefix, repl.Replace(links[i].Linkname))
+		linkErr := unpackFile(restoredPath, links[i], strings.NewReader(""), false)
+		if linkErr != nil {
+			fmt.Printf("%s : %s\n", restoredPath, linkErr.Error())
+			errorCount += 1
+		}
+	}
+
+	if errorCount > 0 {
+		err = errors.New(fmt.Sprintf("Finished with %d errors", errorCount))
+	}
+
+	return err
+}
+
+// `include' gives the names to unpack each entry as (none,
+// if it's not wanted).  It may read the entry's contents
+// itself instead.
+func unpackArchive(archive string, include func(*tar.Header, io.Reader) ([]string, error), prefix string, repl Replacement, encrypt Encrypt, unpackFile func(string, *tar.Header, io.Reader, bool) error) (err error) {
+	fmt.Printf("Restoring %s...\n", archive)
+
+	if len(prefix) > 0 {
+		err = os.MkdirAll(prefix, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	errorCount := 0
+	err = readArchive(archive, encrypt, func(hdr *tar.Header, archTar io.Reader) error {
+		names, err := include(hdr, archTar)
+		if err != nil || len(names) == 0 {
+			return err
+		}
+
+		// If the contents are going to several places, we
+		// need to keep hold of them:
+		var spool *os.File
+		var size int64
+		if len(names) > 1 {
+			spool, size, err = spoolEntry(archTar)
+			if err != nil {
+				return err
+			}
+
+			defer func() {
+				spool.Close()
+				os.Remove(spool.Name())
+			}()
+		}
+
+		for i := 0; i < len(names); i++ {
+			reader := archTar
+			if spool != nil {
+				reader = io.NewSectionReader(spool, 0, size)
+			}
+
+			named := *hdr
+			named.Name = names[i]
+			restoredPath := filepath.Join(prefix, repl.Replace(names[i]))
+			restoreErr := unpackFile(restoredPath, &named, reader, names[i] != hdr.Name)
 			if restoreErr != nil {
 				fmt.Printf("%s : %s\n", restoredPath, restoreErr.Error())
 				errorCount += 1
 			}
 		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
 	}
 
 	if errorCount > 0 {
@@ -425,22 +1225,51 @@ func unpackArchive(archive string, filter Filter, prefix string, repl Replacemen
 
 // File unpack functions ...
 
-func testFile(restoredPath string, hdr *tar.Header, archTar io.Reader) (err error) {
-	fmt.Printf("%s\n", restoredPath)
-	return nil
-}
-
-func restoreFile(restoredPath string, hdr *tar.Header, archTar io.Reader) (err error) {
+// `skipXattrs' lists extended attribute namespaces (or
+// names) not to restore.
+func restoreFile(restoredPath string, hdr *tar.Header, archTar io.Reader, skipXattrs []string) (err error) {
 	info := hdr.FileInfo()
 	mode := info.Mode()
 
+	if hdr.Typeflag == tar.TypeLink {
+		// The target has all the mode etc already.
+		// We might be restoring over an older copy:
+		err = os.MkdirAll(filepath.Dir(restoredPath), 0777)
+		if err == nil {
+			os.Remove(restoredPath)
+			err = os.Link(hdr.Linkname, restoredPath)
+		}
+
+		return
+	}
+
 	if info.IsDir() {
-		err = os.Mkdir(restoredPath, mode.Perm())
+		// We've probably created this already, to hold
+		// files from an earlier archive, and its parents
+		// might not be in the archive at all:
+		err = os.MkdirAll(restoredPath, mode.Perm())
 	} else if (mode & os.ModeSymlink) != 0 {
 		err = os.Symlink(hdr.Linkname, restoredPath)
+	} else if (mode & (os.ModeDevice | os.ModeNamedPipe)) != 0 {
+		err = RestoreSpecial(restoredPath, hdr)
+
+		// Only root can make most devices; carry on
+		// without them if we aren't:
+		if errors.Is(err, os.ErrPermission) {
+			fmt.Printf("%s : Skipping device file (%s)\n", restoredPath, err.Error())
+			return nil
+		}
+	} else if isRefHeader(hdr) {
+		// We restored the contents from another archive
+		// entry already; this just has the mode etc.
+	} else if isChunkedHeader(hdr) {
+		// The contents are the chunks put back together.
+		// Runs of zeroes become holes, as they most likely
+		// were to begin with:
+		err = copyOutOf(restoredPath, archTar, true)
 	} else if (mode & os.ModeType) == 0 {
 		// This is a regular file, write its contents
-		err = copyOutOf(restoredPath, archTar)
+		err = copyOutOf(restoredPath, archTar, isSparseHeader(hdr))
 	}
 
 	// Restore this thing's mode, ownership, etc
@@ -452,6 +1281,10 @@ func restoreFile(restoredPath string, hdr *tar.Header, archTar io.Reader) (err e
 		err = RestoreOwnership(restoredPath, hdr)
 	}
 
+	if err == nil {
+		err = RestoreXattrs(restoredPath, hdr, skipXattrs)
+	}
+
 	if err == nil {
 		// I'm not trying to restore the access time, because
 		// it seems we can't store it correctly.
@@ -459,6 +1292,5 @@ func restoreFile(restoredPath string, hdr *tar.Header, archTar io.Reader) (err e
 		err = os.Chtimes(restoredPath, hdr.ModTime, hdr.ModTime)
 	}
 
-	// TODO Extended attributes
 	return
 }
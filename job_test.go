@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Stores archives as they are, so that tests don't need a
+// passphrase.
+type plainEncrypt struct{}
+
+func (e plainEncrypt) WrapWriter(writer io.WriteSeeker) (io.WriteCloser, error) {
+	return nopWriteCloser{writer}, nil
+}
+
+func (e plainEncrypt) WrapReader(reader io.ReadSeeker) (io.Reader, error) {
+	return reader, nil
+}
+
+// A job backing up a temporary directory, whose editions
+// are a day apart (so that retention rules can tell them
+// apart without waiting).
+type testJob struct {
+	T        *testing.T
+	Dir      string
+	R        *RunningJob
+	Editions []*Edition
+
+	// (The archives are found relative to the working
+	// directory, so we work in the backup directory.)
+	WasDir string
+}
+
+func newTestJob(t *testing.T, job Job) *testJob {
+	dir, err := ioutil.TempDir("", "backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// (The temporary directory might be a symlink.)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dir, "src"), 0755)
+	}
+
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dir, "bk"), 0755)
+	}
+
+	var wasDir string
+	if err == nil {
+		wasDir, err = os.Getwd()
+	}
+
+	if err == nil {
+		err = os.Chdir(filepath.Join(dir, "bk"))
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	job.BaseName = "test"
+	job.Path = filepath.Join(dir, "src")
+	return &testJob{t, dir, &RunningJob{job, nil, filepath.Join(dir, "bk", "job.json")}, nil, wasDir}
+}
+
+func (j *testJob) Close() {
+	os.Chdir(j.WasDir)
+	os.RemoveAll(j.Dir)
+}
+
+// The path of a file being backed up.
+func (j *testJob) Src(name string) string {
+	return filepath.Join(j.R.J.Path, filepath.FromSlash(name))
+}
+
+func (j *testJob) Write(name string, contents string) {
+	err := os.MkdirAll(filepath.Dir(j.Src(name)), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(j.Src(name), []byte(contents), 0644)
+	}
+
+	if err != nil {
+		j.T.Fatal(err)
+	}
+}
+
+func (j *testJob) Link(name string, target string) {
+	err := os.MkdirAll(filepath.Dir(j.Src(name)), 0755)
+	if err == nil {
+		err = os.Link(j.Src(target), j.Src(name))
+	}
+
+	if err != nil {
+		j.T.Fatal(err)
+	}
+}
+
+func (j *testJob) Touch(name string, when time.Time) {
+	err := os.Chtimes(j.Src(name), when, when)
+	if err != nil {
+		j.T.Fatal(err)
+	}
+}
+
+func (j *testJob) Remove(name string) {
+	err := os.Remove(j.Src(name))
+	if err != nil {
+		j.T.Fatal(err)
+	}
+}
+
+func (j *testJob) nextEdition() *Edition {
+	e := &Edition{time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC).AddDate(0, 0, len(j.Editions))}
+	j.Editions = append(j.Editions, e)
+	return e
+}
+
+// Backs up, returning the new edition.
+func (j *testJob) Backup() *Edition {
+	j.R.E = j.nextEdition()
+	err := j.backup(false)
+	if err != nil {
+		j.T.Fatalf("Backup %s : %s", j.R.E.String(), err.Error())
+	}
+
+	return j.R.E
+}
+
+func (j *testJob) backup(resume bool) error {
+	compress, err := NewCompressor(j.R.J.Compression, j.R.J.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	return j.R.DoBackup(new(Filters), "", plainEncrypt{}, compress, nil, resume)
+}
+
+// The size of an edition's archive.
+func (j *testJob) ArchiveSize(e *Edition) int64 {
+	info, err := os.Stat(fmt.Sprintf("%s_%s%s", j.R.J.BaseName, e.String(), ArchiveSuffix))
+	if err != nil {
+		j.T.Fatal(err)
+	}
+
+	return info.Size()
+}
+
+// Leaves what a backup that was interrupted after its
+// first checkpoint would, having archived the given files
+// (and the directory they're in) by then.
+func (j *testJob) Interrupt(names ...string) *Edition {
+	j.R.E = j.nextEdition()
+	compress, err := NewCompressor(j.R.J.Compression, j.R.J.CompressionLevel)
+	if err != nil {
+		j.T.Fatal(err)
+	}
+
+	seenDb, err := NewSeenDb(j.R.GetDbFilename(), plainEncrypt{}, j.R.E)
+	if err != nil {
+		j.T.Fatal(err)
+	}
+	defer seenDb.Abort()
+
+	archive, err := NewArchiveWriter(j.R.GetSegmentFilename(1), plainEncrypt{}, compress)
+	if err != nil {
+		j.T.Fatal(err)
+	}
+
+	info, err := os.Lstat(j.R.J.Path)
+	if err == nil {
+		err = j.R.backupFile(j.R.J.Path, j.R.J.Path, info, info.Mode(), archive, nil)
+	}
+
+	store := new(StoreFilter)
+	for i := 0; err == nil && i < len(names); i++ {
+		item := &pipelineItem{PrefixedPath: j.Src(names[i]), Path: j.Src(names[i])}
+		item.Info, err = os.Lstat(item.Path)
+		if err != nil {
+			break
+		}
+
+		err = seenDb.Update(item.Path, GetFileMeta(item.Info), func(stream bool) (*FileRead, error) {
+			j.R.readFile(item, compress, store, seenDb, archive, stream)
+			return &FileRead{item.Hash, GetFileMeta(item.Info), item.Archived, item.Unstable}, item.ReadErr
+		}, func() error {
+			return j.R.includeFile(item, seenDb, archive)
+		}, func(ref string, refEdition *Edition) error {
+			return j.R.backupRef(item.PrefixedPath, item.Path, ref, refEdition, item.Info, archive.Tar)
+		})
+
+		item.Discard()
+	}
+
+	if err == nil {
+		err = archive.Close(true)
+	} else {
+		archive.Abort()
+	}
+
+	if err == nil {
+		err = seenDb.Checkpoint(j.R.GetCheckpointFilename(), 1, j.Src(names[len(names)-1]))
+	}
+
+	if err != nil {
+		j.T.Fatal(err)
+	}
+
+	return j.R.E
+}
+
+// The editions in the database, and what each one did.
+func (j *testJob) ListEditionStats() []*EditionStats {
+	seenDb, err := NewSeenDb(j.R.GetDbFilename(), plainEncrypt{}, nil)
+	if err != nil {
+		j.T.Fatal(err)
+	}
+	defer seenDb.Close()
+
+	list, err := seenDb.ListEditionStats()
+	if err != nil {
+		j.T.Fatal(err)
+	}
+
+	return list
+}
+
+func (j *testJob) Prune(keep Retention) {
+	err := j.prune(keep)
+	if err != nil {
+		j.T.Fatalf("Prune : %s", err.Error())
+	}
+}
+
+func (j *testJob) prune(keep Retention) error {
+	j.R.J.Keep = keep
+	compress, err := NewCompressor(j.R.J.Compression, j.R.J.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	return j.R.DoPrune(plainEncrypt{}, compress)
+}
+
+// Restores the given edition (or the latest, if nil),
+// returning the contents of each file in it, by name
+// relative to the backed up directory.
+func (j *testJob) Restore(asOf *Edition) map[string]string {
+	return readTree(j.T, j.RestoreDir(asOf))
+}
+
+// Restores the given edition (or the latest, if nil),
+// returning where the backed up directory was restored to.
+func (j *testJob) RestoreDir(asOf *Edition) string {
+	out, err := ioutil.TempDir(j.Dir, "out")
+	if err == nil {
+		err = j.R.DoUnpack(new(Filters), out, new(Replacements), plainEncrypt{}, asOf, Unpack_Restore, nil)
+	}
+
+	if err != nil {
+		j.T.Fatalf("Restore : %s", err.Error())
+	}
+
+	return filepath.Join(out, j.R.J.Path)
+}
+
+// Returns the contents of the files (not directories)
+// under a directory.
+func readTree(t *testing.T, root string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err == nil {
+			var name string
+			name, err = filepath.Rel(root, path)
+			files[filepath.ToSlash(name)] = string(contents)
+		}
+
+		return err
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func checkTree(t *testing.T, what string, files map[string]string, expected map[string]string) {
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("%s : Found %v, expected %v", what, files, expected)
+	}
+}
+
+func TestResume(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a", "contents of a")
+	j.Write("b", "contents of b")
+	j.Write("c", "contents of c")
+	j.Backup()
+
+	// The backup gets as far as a, and then c changes
+	// before we resume:
+	j.Write("a", "new contents of a")
+	e := j.Interrupt("a")
+	j.Write("c", "new contents of c")
+	err := j.backup(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.R.E.Unix() != e.Unix() {
+		t.Errorf("Resumed edition %s, expected %s", j.R.E.String(), e.String())
+	}
+
+	expected := map[string]string{
+		"a": "new contents of a",
+		"b": "contents of b",
+		"c": "new contents of c",
+	}
+
+	checkTree(t, "Resumed", j.Restore(e), expected)
+
+	// With nothing to resume, we just back up:
+	j.Write("b", "new contents of b")
+	j.R.E = j.nextEdition()
+	err = j.backup(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected["b"] = "new contents of b"
+	checkTree(t, "Backed up", j.Restore(nil), expected)
+	if list := j.ListEditionStats(); len(list) != 3 || list[2].E.Unix() != j.R.E.Unix() {
+		t.Errorf("Found %d editions", len(list))
+	}
+}
+
+// Files deleted since an edition aren't restored with it,
+// and files deleted before it are restored if they came
+// back.
+func TestDeletedFiles(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a", "contents of a")
+	j.Write("b", "contents of b")
+	j.Write("dir/c", "contents of c")
+	j.Backup()
+
+	j.Remove("a")
+	j.Remove("dir/c")
+	j.Remove("dir")
+	j.Backup()
+
+	j.Write("a", "new contents of a")
+	j.Backup()
+	j.Remove("b")
+	j.Backup()
+
+	checkTree(t, "Restored", j.Restore(nil), map[string]string{
+		"a": "new contents of a",
+	})
+}
+
+// Restoring as of an edition gives the files as they were
+// then, whatever happened later.
+func TestRestoreAsOf(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	expected := []map[string]string{
+		{"a": "contents of a", "b": "contents of b"},
+		{"a": "new contents of a", "b": "contents of b", "c": "contents of c"},
+		{"a": "new contents of a", "c": "contents of c"},
+		{"a": "contents of a", "c": "contents of c"},
+	}
+
+	var editions []*Edition
+	for i := 0; i < len(expected); i++ {
+		if i > 0 {
+			for name := range expected[i-1] {
+				if _, found := expected[i][name]; !found {
+					j.Remove(name)
+				}
+			}
+		}
+
+		for name, contents := range expected[i] {
+			j.Write(name, contents)
+		}
+
+		editions = append(editions, j.Backup())
+	}
+
+	for i := 0; i < len(editions); i++ {
+		checkTree(t, editions[i].String(), j.Restore(editions[i]), expected[i])
+	}
+}
+
+// Restoring writes each file once, as it is in the latest
+// edition, even where earlier editions had something else
+// (such as a directory) by the same name.
+func TestRestoreNewest(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a/b", "contents of b")
+	j.Write("c", "contents of c")
+	j.Backup()
+
+	j.Remove("a/b")
+	j.Remove("a")
+	j.Write("a", "contents of a")
+	j.Remove("c")
+	j.Write("c/d", "contents of d")
+	j.Backup()
+
+	checkTree(t, "Restored", j.Restore(nil), map[string]string{
+		"a":   "contents of a",
+		"c/d": "contents of d",
+	})
+}
+
+// Hard links are restored as links to the same file.
+func TestHardLinks(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a", "contents of a")
+	j.Link("b", "a")
+	j.Backup()
+
+	// (Linking to a file backed up already.)
+	j.Link("dir/c", "a")
+	j.Backup()
+
+	dir := j.RestoreDir(nil)
+	checkTree(t, "Restored", readTree(t, dir), map[string]string{
+		"a":     "contents of a",
+		"b":     "contents of a",
+		"dir/c": "contents of a",
+	})
+
+	a, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"b", "dir/c"} {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !os.SameFile(a, info) {
+			t.Errorf("Restored %s as a separate file", name)
+		}
+	}
+}
@@ -16,14 +16,18 @@ func main() {
 	 * That file itself is an encoding of the Job
 	 * structure. (backup.go)
 	 * TODO : Support:
-	 * - Removing old editions?
-	 * - Decrypt only (producing the .tar.gz)?
 	 * - Log file and stats printed?
 	 */
 	backup := flag.Bool("backup", false, "Set this to do a backup")
-	test := flag.Bool("test", false, "Set this to test the backup files and list their contents")
+	test := flag.Bool("test", false, "Set this to test the backup files against the database and list their contents")
 	restore := flag.Bool("restore", false, "Set this to do a restore")
 	listEditions := flag.Bool("listEditions", false, "Set this to just list the editions of this backup")
+	diff := flag.Bool("diff", false, "Set this to compare the latest edition with the files it was taken from")
+	prune := flag.Bool("prune", false, "Set this to remove old editions according to each job's Keep policy")
+	stats := flag.Bool("stats", false, "Set this to show what the backup run behind each edition did")
+	rebuildDb := flag.Bool("rebuildDb", false, "Set this to rebuild a lost database from the archives")
+	export := flag.Bool("export", false, "Set this to write out unencrypted copies of the archives")
+	resume := flag.Bool("resume", false, "With -backup, carry on with an interrupted backup from its last checkpoint, if there is one")
 
 	jobs := flag.String("job", "backup.json", "Json file describing the backup job")
 	prefix := flag.String("prefix", "", "Optional path prefix")
@@ -33,14 +37,36 @@ func main() {
 	include := flag.String("include", "", fmt.Sprintf("Optional list of <path>%s<path>%s... to include", sep, sep))
 	exclude := flag.String("exclude", "", fmt.Sprintf("Optional list of <path>%s<path>%s... to exclude", sep, sep))
 	removeAfter := flag.String("removeAfter", "", fmt.Sprintf("Optional edition to base the backup on"))
+	edition := flag.String("edition", "", fmt.Sprintf("Optional edition to restore, test or export (defaults to the latest)"))
+	out := flag.String("out", ".", "Directory to export into")
+	skipXattrs := flag.String("skipXattrs", "", fmt.Sprintf("Optional list of <namespace>%s<namespace>%s... of extended attributes not to restore, e.g. security%strusted", sep, sep, sep))
+	oneFileSystem := flag.Bool("oneFileSystem", false, "With -backup or -diff, override each job's OneFileSystem setting")
+	merge := flag.Bool("merge", false, "With -export, write a single tar of the chosen edition instead of each archive's tar.gz")
 
 	flag.Parse()
 
+	// We only override the jobs' OneFileSystem settings
+	// if it was given explicitly:
+	var oneFileSystemOverride *bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "oneFileSystem" {
+			oneFileSystemOverride = oneFileSystem
+		}
+	})
+
 	includeArray := strings.Split(*include, sep)
 	excludeArray := strings.Split(*exclude, sep)
 
 	filter := new(Filters).WithIncludes(includeArray).WithExcludes(excludeArray)
 
+	// We're about to change directory, so pin down the
+	// export directory first:
+	outDir, err := filepath.Abs(*out)
+	if err != nil {
+		fmt.Printf("out : %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	// Change into the directory of the job spec:
 	oldWd, err := os.Getwd()
 	if err != nil {
@@ -68,9 +94,23 @@ func main() {
 			}
 		}
 
-		err = RunBackup(jobFile, filter, *prefix, removeAfterEdition)
+		// (A resumed backup already has its edition.)
+		if removeAfterEdition != nil && *resume {
+			fmt.Printf("resume : Can't be combined with removeAfter\n")
+			os.Exit(1)
+		}
+
+		err = RunBackup(jobFile, filter, *prefix, removeAfterEdition, *resume, oneFileSystemOverride)
+	} else if *diff {
+		err = RunDiff(jobFile, filter, *prefix, oneFileSystemOverride)
 	} else if *listEditions {
 		err = RunListEditions(jobFile)
+	} else if *stats {
+		err = RunStats(jobFile)
+	} else if *rebuildDb {
+		err = RunRebuildDb(jobFile)
+	} else if *prune {
+		err = RunPrune(jobFile)
 	} else {
 		repl := new(Replacements)
 		err = repl.AddReplStart(*replaceStart)
@@ -91,17 +131,35 @@ func main() {
 			os.Exit(1)
 		}
 
-		what := -1
-		if *restore {
-			what = Unpack_Restore
-		} else if *test {
-			what = Unpack_Test
-		} else {
-			fmt.Printf("No action specified\n")
-			os.Exit(1)
+		var asOfEdition *Edition
+		if len(*edition) > 0 {
+			asOfEdition, err = EditionFromString(*edition)
+			if err != nil {
+				fmt.Printf("edition : %s\n", err.Error())
+				os.Exit(1)
+			}
 		}
 
-		err = RunUnpack(jobFile, filter, *prefix, repl, what)
+		if *export {
+			err = RunExport(jobFile, filter, repl, asOfEdition, outDir, *merge)
+		} else {
+			what := -1
+			if *restore {
+				what = Unpack_Restore
+			} else if *test {
+				what = Unpack_Test
+			} else {
+				fmt.Printf("No action specified\n")
+				os.Exit(1)
+			}
+
+			var skipXattrsArray []string
+			if len(*skipXattrs) > 0 {
+				skipXattrsArray = strings.Split(*skipXattrs, sep)
+			}
+
+			err = RunUnpack(jobFile, filter, *prefix, repl, asOfEdition, what, skipXattrsArray)
+		}
 	}
 
 	if err != nil {
@@ -0,0 +1,299 @@
+/* Works on the files a backup finds ahead of time, on as
+ * many goroutines as there are CPUs, so that the backup is
+ * held up by the disk rather than by a single CPU.  The
+ * archive is still written in the order we walk the tree,
+ * one file at a time; that just goes quicker for having
+ * the files read, hashed and (mostly) compressed already.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"runtime"
+	"time"
+)
+
+const (
+	// Smaller files aren't worth compressing by
+	// themselves, since each one costs a new member of the
+	// compressed stream, so we just keep them in memory.
+	MemberMinSize = 256 << 10
+
+	// Bigger files would use too much temporary space to
+	// read ahead of time, so they go straight into the
+	// archive.
+	MemberMaxSize = 16 << 20
+)
+
+// A file the walk found, and the work done on it ahead of
+// time.
+type pipelineItem struct {
+	PrefixedPath string
+	Path         string
+	Info         os.FileInfo
+
+	// Closed once the work is done.
+	Done chan struct{}
+
+	// Whether we've read the file, and the hash of what
+	// we read.
+	Read    bool
+	Hash    []byte
+	ReadErr error
+
+	// How much we read, including any attempts we threw
+	// away.
+	BytesRead int64
+
+	// What we read, ready to archive: either a compressed
+	// member, or uncompressed entries, or chunks (which
+	// are in the archive already).
+	Member  *os.File
+	Entries *bytes.Buffer
+	Chunks  []FileChunk
+
+	// Whether the whole entry is in the archive already.
+	Archived bool
+
+	// Whether we only hashed the file, which was too big
+	// to keep aside; it's read again if we want it.
+	HashOnly bool
+
+	// Whether the entries should be stored without
+	// compression.
+	Stored bool
+
+	// Whether the file was still changing when we last
+	// read it.
+	Unstable bool
+}
+
+func (item *pipelineItem) Discard() {
+	if item.Member != nil {
+		item.Member.Close()
+		os.Remove(item.Member.Name())
+		item.Member = nil
+	}
+}
+
+// The files we're working on, in the order we found them.
+type backupPipeline struct {
+	Queue []*pipelineItem
+
+	// Holds a token for each busy worker.
+	Workers chan struct{}
+
+	// How far ahead of the archive we go.
+	Window int
+}
+
+// `workers' is the number of goroutines to work on, or 0
+// for one per CPU.
+func newBackupPipeline(workers int) *backupPipeline {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return &backupPipeline{nil, make(chan struct{}, workers), 2*workers + 2}
+}
+
+// Queues up a file, starting the work on it (if any) on a
+// worker goroutine.
+func (p *backupPipeline) Add(item *pipelineItem, work func(*pipelineItem)) {
+	item.Done = make(chan struct{})
+	if work == nil {
+		close(item.Done)
+	} else {
+		go func() {
+			p.Workers <- struct{}{}
+			work(item)
+			<-p.Workers
+			close(item.Done)
+		}()
+	}
+
+	p.Queue = append(p.Queue, item)
+}
+
+// Returns the oldest file once its work is done, if the
+// queue is full (or if `all' is set, and there's anything
+// left in it); otherwise nil.
+func (p *backupPipeline) Next(all bool) *pipelineItem {
+	if len(p.Queue) == 0 || (!all && len(p.Queue) < p.Window) {
+		return nil
+	}
+
+	item := p.Queue[0]
+	p.Queue = p.Queue[1:]
+	<-item.Done
+	return item
+}
+
+// Throws away the work on any files left.
+func (p *backupPipeline) Abort() {
+	for item := p.Next(true); item != nil; item = p.Next(true) {
+		item.Discard()
+	}
+}
+
+// Decides whether to read a file ahead of time, which we
+// do if the database says it might have changed.  Returns
+// the work to do, or nil if there's nothing to do.
+func (r *RunningJob) planWork(seenDb Seen, item *pipelineItem, compress Compressor, store *StoreFilter) func(*pipelineItem) {
+	info := item.Info
+	if (info.Mode() & os.ModeType) != 0 {
+		return nil
+	}
+
+	// (If this goes wrong, we'll find out again when we
+	// come to archive the file.)
+	needed, _, err := seenDb.CheckUpdate(item.Path, GetFileMeta(info))
+	if err != nil || !needed {
+		return nil
+	}
+
+	// Chunked files can only be read in order, and most
+	// hard links don't need reading at all:
+	_, linked := GetHardLinkId(info)
+	if info.Size() > MemberMaxSize || linked || r.isChunked(info) {
+		return nil
+	}
+
+	return func(item *pipelineItem) {
+		r.readFile(item, compress, store, nil, nil, false)
+	}
+}
+
+// Reads a file, making its archive entries and hashing
+// exactly the contents that go into them.  They're kept
+// aside until we know whether we want them -- except for
+// the chunks of a chunked file, which go straight into the
+// archive (if the file hasn't changed, the backup has them
+// all already), and files too big to keep aside, which go
+// straight in whole if `stream' is set and are only hashed
+// otherwise; so those need the database and archive.
+func (r *RunningJob) readFile(item *pipelineItem, compress Compressor, store *StoreFilter, seenDb Seen, archive *ArchiveWriter, stream bool) {
+	retries := r.J.Retries
+	if retries == 0 {
+		retries = ReadRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		r.readFileOnce(item, compress, store, seenDb, archive, stream)
+
+		// If the file changed while we were reading it,
+		// what we read might be a mixture of old and new,
+		// so we try again (after giving it a moment) --
+		// unless it's in the archive already:
+		after, err := os.Lstat(item.PrefixedPath)
+		item.Unstable = err == nil && (after.Size() != item.Info.Size() || !after.ModTime().Equal(item.Info.ModTime()))
+		if !item.Unstable || item.Archived || attempt >= retries {
+			return
+		}
+
+		item.Discard()
+		item.Info = after
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+}
+
+func (r *RunningJob) readFileOnce(item *pipelineItem, compress Compressor, store *StoreFilter, seenDb Seen, archive *ArchiveWriter, stream bool) {
+	item.Read = true
+	item.Hash = nil
+	item.HashOnly = false
+	item.Stored = store.Store(item.PrefixedPath)
+	h := sha256.New()
+	counted := io.MultiWriter(h, byteCounter{&item.BytesRead})
+	write := func(archive *ArchiveWriter) error {
+		return r.backupFile(item.PrefixedPath, item.Path, item.Info, item.Info.Mode(), archive, counted)
+	}
+
+	if r.isChunked(item.Info) {
+		item.ReadErr = archive.SetStored(item.Stored)
+		if item.ReadErr == nil {
+			item.Chunks, item.ReadErr = r.chunkFile(item.PrefixedPath, seenDb, archive, counted)
+		}
+	} else if item.Info.Size() > MemberMaxSize && archive != nil {
+		if stream {
+			// We hash it as it goes in, and sort out whether
+			// we wanted it afterwards:
+			item.ReadErr = archive.SetStored(item.Stored)
+			if item.ReadErr == nil {
+				item.Archived = true
+				item.ReadErr = write(archive)
+			}
+		} else {
+			item.HashOnly = true
+			item.ReadErr = copyInto(item.PrefixedPath, counted, item.Info.Size())
+		}
+	} else if item.Info.Size() < MemberMinSize {
+		item.Entries, item.ReadErr = bufferEntries(write)
+	} else {
+		c := compress
+		if item.Stored && compress.Store() != nil {
+			c = compress.Store()
+		}
+
+		item.Member, item.ReadErr = spoolMember(c, write)
+	}
+
+	if item.ReadErr == nil {
+		item.Hash = h.Sum(nil)
+	}
+}
+
+// Counts what's written through it.
+type byteCounter struct {
+	N *int64
+}
+
+func (c byteCounter) Write(data []byte) (int, error) {
+	*c.N += int64(len(data))
+	return len(data), nil
+}
+
+// Archives a file that we've read.
+func (r *RunningJob) includeFile(item *pipelineItem, seenDb Seen, archive *ArchiveWriter) error {
+	if item.Archived {
+		return nil
+	}
+
+	if item.HashOnly {
+		// It goes in now, and if it has changed since we
+		// hashed it, it goes in flagged as it is now:
+		err := archive.SetStored(item.Stored)
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		err = r.backupFile(item.PrefixedPath, item.Path, item.Info, item.Info.Mode(), archive, io.MultiWriter(h, byteCounter{&item.BytesRead}))
+		if err == nil && !bytes.Equal(h.Sum(nil), item.Hash) {
+			item.Hash = h.Sum(nil)
+			item.Unstable = true
+		}
+
+		return err
+	}
+
+	if item.Member != nil {
+		return archive.AppendMember(item.Member)
+	}
+
+	// There's no point compressing contents that are
+	// compressed already:
+	err := archive.SetStored(item.Stored)
+	if err != nil {
+		return err
+	}
+
+	if item.Entries != nil {
+		return archive.AppendEntries(item.Entries)
+	}
+
+	return r.backupChunked(item.PrefixedPath, item.Path, item.Info, item.Hash, item.Chunks, seenDb, archive)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// However many workers read ahead, every file goes into
+// the archive as it was, in members of every kind.
+func TestPipelineWorkers(t *testing.T) {
+	sizes := []int{10, MemberMinSize - 1, MemberMinSize, 2 * MemberMinSize, MemberMaxSize + 1}
+	workers := []int{1, 4}
+	for i := 0; i < len(workers); i++ {
+		j := newTestJob(t, Job{Workers: workers[i]})
+		defer j.Close()
+
+		expected := make(map[string]string)
+		for k := 0; k < 20; k++ {
+			name := fmt.Sprintf("dir%d/file%d", k%3, k)
+			expected[name] = string(randomData(int64(k), sizes[k%len(sizes)]))
+			j.Write(name, expected[name])
+		}
+
+		j.Backup()
+		files := j.Restore(nil)
+		for name, contents := range expected {
+			if files[name] != contents {
+				t.Errorf("%d workers : Restored %d bytes of %s, expected %d", workers[i], len(files[name]), name, len(contents))
+			}
+		}
+
+		if len(files) != len(expected) {
+			t.Errorf("%d workers : Restored %d files, expected %d", workers[i], len(files), len(expected))
+		}
+	}
+}
+
+// Files too big to read ahead only go into the archive
+// when their contents have changed.
+func TestBigFiles(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	contents := string(randomData(4, MemberMaxSize+1))
+	when := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	j.Write("big", contents)
+	j.Touch("big", when)
+	e := j.Backup()
+	if size := j.ArchiveSize(e); size < MemberMaxSize {
+		t.Errorf("First archive has %d bytes", size)
+	}
+
+	tests := []struct {
+		Name     string
+		Change   func()
+		Archived bool
+	}{
+		{"touched", func() {}, false},
+		{"changed", func() {
+			contents = string(randomData(5, MemberMaxSize+1))
+			j.Write("big", contents)
+		}, true},
+		{"grown", func() {
+			contents += "more"
+			j.Write("big", contents)
+		}, true},
+		{"touched again", func() {}, false},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		tests[i].Change()
+		when = when.Add(time.Hour)
+		j.Touch("big", when)
+		e = j.Backup()
+		if size := j.ArchiveSize(e); (size > MemberMaxSize) != tests[i].Archived {
+			t.Errorf("%s : Archive has %d bytes", tests[i].Name, size)
+		}
+
+		files := j.Restore(nil)
+		if files["big"] != contents {
+			t.Errorf("%s : Restored %d bytes", tests[i].Name, len(files["big"]))
+		}
+	}
+}
+
+// A file that changes while we read it is read again, or
+// flagged if we're not to.
+func TestReadFileChanged(t *testing.T) {
+	tests := []struct {
+		Retries  int
+		Unstable bool
+	}{
+		{0, false},
+		{-1, true},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		j := newTestJob(t, Job{Retries: tests[i].Retries})
+		defer j.Close()
+
+		compress, err := NewCompressor("", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// (We find it changed as soon as we start.)
+		j.Write("a", "contents of a")
+		item := &pipelineItem{PrefixedPath: j.Src("a"), Path: j.Src("a")}
+		item.Info, err = os.Lstat(item.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j.Write("a", "new contents of a")
+		j.R.readFile(item, compress, new(StoreFilter), nil, nil, false)
+		item.Discard()
+		if item.ReadErr != nil {
+			t.Fatal(item.ReadErr)
+		}
+
+		if item.Unstable != tests[i].Unstable {
+			t.Errorf("%d retries : Unstable %v", tests[i].Retries, item.Unstable)
+		}
+
+		hash := sha256.Sum256([]byte("new contents of a"))
+		if !tests[i].Unstable && !bytes.Equal(item.Hash, hash[:]) {
+			t.Errorf("%d retries : Hashed something else", tests[i].Retries)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/* Removes old editions according to the job's retention
+ * policy.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+func (r *RunningJob) DoPrune(encrypt Encrypt, compress Compressor) (err error) {
+	fmt.Printf("Pruning %s ...\n", r.J.BaseName)
+
+	// Refuse to prune without a policy, rather than
+	// throwing everything but the latest away:
+	if r.J.Keep.IsEmpty() {
+		return errors.New(fmt.Sprintf("%s : No retention policy (Keep) set", r.J.BaseName))
+	}
+
+	// Clearing up would throw away the checkpoint of an
+	// interrupted backup, which might yet be resumed:
+	if _, statErr := os.Stat(r.GetCheckpointFilename()); statErr == nil {
+		return errors.New(fmt.Sprintf("%s : A backup was interrupted; resume it with -backup -resume (or run a new backup) before pruning", r.J.BaseName))
+	}
+
+	err = r.RemoveLeftovers()
+	if err != nil {
+		return err
+	}
+
+	archives, err := r.GetOldEditionFilenames()
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(archives)
+
+	editions := new(SortedEditions)
+	for i := 0; i < archives.Len(); i++ {
+		editions.Append(archives.Names[i].E)
+	}
+
+	keep := r.J.Keep.Keep(editions)
+
+	// Open up the database:
+	fmt.Printf("Opening database %s\n", r.GetDbFilename())
+	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, r.E)
+	if err != nil {
+		return err
+	}
+
+	seenDb.KeepUpgrade()
+
+	closed := false
+	defer func() {
+		if !closed {
+			seenDb.Abort()
+		}
+	}()
+
+	index := make(map[int64]int)
+	for i := 0; i < archives.Len(); i++ {
+		index[archives.Names[i].E.Unix()] = i
+	}
+
+	// Each expired edition is merged into the next one
+	// that we're keeping.  The files in it that are still
+	// current at that point get copied across into that
+	// edition's archive.  Any others whose contents are
+	// still referred to get copied to where they're
+	// referred from.
+	mergeInto := make(map[int][]int)
+	moved := make(map[int]map[string]struct{})
+	copies := make(map[int][]archiveCopy)
+	var expired []int
+	target := -1
+	for i := archives.Len() - 1; i >= 0; i-- {
+		if keep[i] {
+			target = i
+			continue
+		}
+
+		fmt.Printf("%s : Expired\n", archives.GetName(i))
+		var names []string
+		var refCopies []RefCopy
+		names, refCopies, err = seenDb.MergeEdition(archives.Names[i].E, archives.Names[target].E)
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < len(refCopies); j++ {
+			into, found := index[refCopies[j].E.Unix()]
+			if !found {
+				return errors.New(fmt.Sprintf("%s : No archive for edition %s", refCopies[j].Filename, refCopies[j].E.String()))
+			}
+
+			source, found := index[refCopies[j].SourceE.Unix()]
+			if !found {
+				return errors.New(fmt.Sprintf("%s : No archive for edition %s", refCopies[j].Source, refCopies[j].SourceE.String()))
+			}
+
+			copies[into] = append(copies[into], archiveCopy{source, refCopies[j].Source, refCopies[j].Filename})
+		}
+
+		expired = append(expired, i)
+		if len(names) > 0 {
+			mergeInto[target] = append(mergeInto[target], i)
+			moved[i] = make(map[string]struct{})
+			for j := 0; j < len(names); j++ {
+				moved[i][names[j]] = struct{}{}
+			}
+		}
+	}
+
+	if len(expired) == 0 {
+		fmt.Printf("Nothing to prune\n")
+		return nil
+	}
+
+	for i := 0; i < archives.Len(); i++ {
+		if len(mergeInto[i]) > 0 || len(copies[i]) > 0 {
+			err = mergeArchives(archives, i, mergeInto[i], moved, copies[i], encrypt, compress)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Only once the database is safely written can we get
+	// rid of the old archives:
+	closed = true
+	err = seenDb.Close()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(expired); i++ {
+		fmt.Printf("Removing %s\n", archives.GetName(expired[i]))
+		err = os.Remove(archives.GetName(expired[i]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Contents to copy out of an expired archive, under
+// another name.
+type archiveCopy struct {
+	From     int
+	Source   string
+	Filename string
+}
+
+// Rewrites the archive at `into', appending the moved
+// files from each of the `from' archives, and filling in
+// the copied contents in place of the references to them.
+func mergeArchives(archives *ArchiveNames, into int, from []int, moved map[int]map[string]struct{}, copies []archiveCopy, encrypt Encrypt, compress Compressor) error {
+	name := archives.GetName(into)
+	fmt.Printf("Rewriting %s\n", name)
+
+	spooled := make(map[string]*os.File)
+	defer func() {
+		for _, spool := range spooled {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+
+	for i := 0; i < len(copies); i++ {
+		c := copies[i]
+		err := readArchive(archives.GetName(c.From), encrypt, func(hdr *tar.Header, reader io.Reader) error {
+			if hdr.Name != c.Source || (hdr.FileInfo().Mode()&os.ModeType) != 0 || hdr.Typeflag == tar.TypeLink || isRefHeader(hdr) {
+				return nil
+			}
+
+			spool, _, err := spoolEntry(reader)
+			if err == nil {
+				spooled[c.Filename] = spool
+			}
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, found := spooled[c.Filename]; !found {
+			return errors.New(fmt.Sprintf("%s : Not found in %s", c.Source, archives.GetName(c.From)))
+		}
+	}
+
+	return writeArchive(name, encrypt, compress, func(archTar *tar.Writer) error {
+		// (A hard link that gets a copy becomes a file.)
+		writeEntry := func(hdr *tar.Header, reader io.Reader) error {
+			spool, found := spooled[hdr.Name]
+			if !found || !(isRefHeader(hdr) || hdr.Typeflag == tar.TypeLink) {
+				return copyEntry(archTar, hdr, reader)
+			}
+
+			size, err := spool.Seek(0, io.SeekEnd)
+			if err == nil {
+				_, err = spool.Seek(0, io.SeekStart)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			copied := clearRefHeader(hdr, size)
+			copied.Typeflag = tar.TypeReg
+			copied.Linkname = ""
+			return copyEntry(archTar, copied, spool)
+		}
+
+		// Everything that's already there...
+		err := readArchive(name, encrypt, writeEntry)
+		if err != nil {
+			return err
+		}
+
+		// ...followed by the files we're keeping from the
+		// expired editions:
+		for i := 0; i < len(from); i++ {
+			fromMoved := moved[from[i]]
+			err = readArchive(archives.GetName(from[i]), encrypt, func(hdr *tar.Header, reader io.Reader) error {
+				if _, found := fromMoved[hdr.Name]; !found || (hdr.FileInfo().Mode()&os.ModeType) != 0 {
+					return nil
+				}
+
+				return writeEntry(hdr, reader)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
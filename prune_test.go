@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+// A hard link keeps its contents when the file it was
+// linked to has gone and the edition that had them is
+// pruned.
+func TestPruneLinkTargetGone(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a", "contents of a")
+	j.Link("b", "a")
+	j.Write("c", "contents of c")
+	j.Link("d", "c")
+	j.Backup()
+
+	// a goes, and c gets new contents (but d keeps the old
+	// ones):
+	j.Remove("a")
+	j.Remove("c")
+	j.Write("c", "new contents of c")
+	j.Backup()
+	j.Backup()
+
+	j.Prune(Retention{Daily: 1})
+	checkTree(t, "After pruning", j.Restore(nil), map[string]string{
+		"b": "contents of a",
+		"c": "new contents of c",
+		"d": "contents of c",
+	})
+
+	// And once more, with the edition the links were
+	// converted into pruned too:
+	j.Backup()
+	j.Prune(Retention{Daily: 1})
+	checkTree(t, "After pruning twice", j.Restore(nil), map[string]string{
+		"b": "contents of a",
+		"c": "new contents of c",
+		"d": "contents of c",
+	})
+}
+
+// An interrupted backup can still be resumed after trying
+// to prune.
+func TestPruneInterrupted(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a", "contents of a")
+	j.Backup()
+	j.Write("a", "new contents of a")
+	j.Write("b", "contents of b")
+	j.Backup()
+
+	j.Write("b", "new contents of b")
+	e := j.Interrupt("a", "b")
+	err := j.prune(Retention{Daily: 1})
+	if err == nil {
+		t.Fatalf("Pruned with a backup to resume")
+	}
+
+	err = j.backup(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.R.E.Unix() != e.Unix() {
+		t.Errorf("Resumed edition %s, expected %s", j.R.E.String(), e.String())
+	}
+
+	j.Prune(Retention{Daily: 1})
+	if list := j.ListEditionStats(); len(list) != 1 {
+		t.Errorf("Kept %d editions", len(list))
+	}
+
+	checkTree(t, "After pruning", j.Restore(nil), map[string]string{
+		"a": "new contents of a",
+		"b": "new contents of b",
+	})
+}
@@ -0,0 +1,281 @@
+/* Rebuilds a lost seen database from the archives.  Each
+ * archive holds everything that changed in its edition, so
+ * reading them in order gives back nearly all the database
+ * had, except that:
+ * - the archives don't record deletions, so a deleted file
+ *   stays in the database until the next backup notices it
+ *   has gone (and the rebuilt editions can't be restored as
+ *   they were);
+ * - the archives' headers only have mtimes to the second,
+ *   and no ctimes or inodes, so the entries are flagged as
+ *   rebuilt, and compared with what we know;
+ * - archives from before chunked files' headers listed
+ *   their chunks don't say which chunks make up those
+ *   files, so they are left out, and stored again at the
+ *   next backup.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func (r *RunningJob) DoRebuildDb(encrypt Encrypt) (err error) {
+	fmt.Printf("Rebuilding database %s ...\n", r.GetDbFilename())
+
+	// Never write over a database, however broken:
+	if _, statErr := os.Stat(r.GetDbFilename()); statErr == nil {
+		return errors.New(fmt.Sprintf("%s : Already exists; move it aside to rebuild it", r.GetDbFilename()))
+	}
+
+	archives, err := r.GetOldEditionFilenames()
+	if err != nil {
+		return err
+	}
+
+	if archives.Len() == 0 {
+		return errors.New(fmt.Sprintf("%s : No archives found", r.J.BaseName))
+	}
+
+	sort.Sort(archives)
+
+	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, nil)
+	if err != nil {
+		return err
+	}
+
+	closed := false
+	defer func() {
+		if !closed {
+			seenDb.Abort()
+		}
+	}()
+
+	problems := 0
+	report := func(path string, problem string) {
+		fmt.Printf("%s : %s\n", path, problem)
+		problems += 1
+	}
+
+	files := int64(0)
+	for i := 0; i < archives.Len(); i++ {
+		fmt.Printf("Reading %s...\n", archives.GetName(i))
+		seenDb.E = archives.Names[i].E
+		seenDb.Added = 0
+
+		err = r.rebuildEdition(seenDb, archives.GetName(i), encrypt, report)
+		if err != nil {
+			return err
+		}
+
+		var info os.FileInfo
+		info, err = os.Stat(archives.GetName(i))
+		if err != nil {
+			return err
+		}
+
+		files += seenDb.Added
+		err = seenDb.RecordEdition(&EditionStats{Added: seenDb.Added, BytesStored: info.Size()})
+		if err != nil {
+			return err
+		}
+	}
+
+	closed = true
+	err = seenDb.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s : Rebuilt %d files in %d editions\n", r.J.BaseName, files, archives.Len())
+	if problems > 0 {
+		return errors.New(fmt.Sprintf("%s : Found %d problems", r.J.BaseName, problems))
+	}
+
+	return nil
+}
+
+// Adds the entries of one archive to the database, as
+// the database's current edition.
+func (r *RunningJob) rebuildEdition(seenDb *SeenDb, archive string, encrypt Encrypt, report func(string, string)) error {
+	// References and hard links can be to files later in
+	// the same archive, so we do them at the end:
+	var refs, links []*tar.Header
+	readErr := readArchive(archive, encrypt, func(hdr *tar.Header, reader io.Reader) error {
+		if isChunkEntry(hdr) {
+			h := sha256.New()
+			size, err := io.Copy(h, reader)
+			if err != nil {
+				return err
+			}
+
+			hash := strings.TrimPrefix(hdr.Name, ChunkPrefix)
+			if hex.EncodeToString(h.Sum(nil)) != hash {
+				report(hdr.Name, "Hash mismatch")
+				return nil
+			}
+
+			return seenDb.AddChunk(hash, size, func() error {
+				return nil
+			})
+		}
+
+		if (hdr.FileInfo().Mode() & os.ModeType) != 0 {
+			return nil
+		}
+
+		switch {
+		case isChunkedHeader(hdr):
+			return rebuildChunked(seenDb, hdr, report)
+
+		case isRefHeader(hdr):
+			refs = append(refs, hdr)
+			return nil
+
+		case hdr.Typeflag == tar.TypeLink:
+			links = append(links, hdr)
+			return nil
+		}
+
+		h := sha256.New()
+		size, err := io.Copy(h, reader)
+		if err != nil {
+			return err
+		}
+
+		return rebuildEntry(seenDb, hdr, &SeenEntry{Mtime: hdr.ModTime, Size: size, Hash: h.Sum(nil)}, nil, report)
+	})
+
+	if readErr != nil {
+		// Whatever we read before the error is good:
+		report(archive, readErr.Error())
+	}
+
+	// (References are always to a file with contents,
+	// but a link can be to a reference.)
+	for i := 0; i < len(refs); i++ {
+		target, err := findRefTarget(seenDb, refs[i])
+		if err != nil {
+			return err
+		}
+
+		if target == nil {
+			report(refs[i].Name, fmt.Sprintf("Missing contents of %s", refs[i].PAXRecords[RefNameKey]))
+			continue
+		}
+
+		err = rebuildEntry(seenDb, refs[i], &SeenEntry{Mtime: refs[i].ModTime, Size: target.Size, Hash: target.Hash, Ref: refs[i].PAXRecords[RefNameKey], RefE: target.E}, nil, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(links); i++ {
+		target, err := seenDb.GetLatest(links[i].Linkname, seenDb.E)
+		if err != nil {
+			return err
+		}
+
+		if target == nil || target.IsDeleted() {
+			report(links[i].Name, fmt.Sprintf("Missing link target %s", links[i].Linkname))
+			continue
+		}
+
+		err = rebuildEntry(seenDb, links[i], &SeenEntry{Mtime: links[i].ModTime, Size: target.Size, Hash: target.Hash, Link: links[i].Linkname}, nil, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Finds the entry holding the contents that a reference
+// refers to, or nil if there isn't one.
+func findRefTarget(seenDb *SeenDb, hdr *tar.Header) (*SeenEntry, error) {
+	ref := hdr.PAXRecords[RefNameKey]
+	refEditionUnix, err := strconv.ParseInt(hdr.PAXRecords[RefEditionKey], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	refEdition := EditionFromUnix(refEditionUnix)
+	target, err := seenDb.GetEntry(ref, refEdition)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pruning moves contents into a later edition without
+	// changing the references to them in the archives:
+	if target == nil {
+		target, err = seenDb.GetLatest(ref, seenDb.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if target != nil && target.E.Unix() < refEditionUnix {
+			target = nil
+		}
+	}
+
+	if target == nil || target.IsDeleted() || target.Link != "" || target.Ref != "" {
+		return nil, nil
+	}
+
+	return target, nil
+}
+
+// Adds a file stored in chunks, going by the chunks its
+// header lists.  (Their own entries came before it.)
+func rebuildChunked(seenDb *SeenDb, hdr *tar.Header, report func(string, string)) error {
+	chunks, err := parseChunkList(hdr)
+	if err != nil {
+		report(hdr.Name, err.Error())
+		return nil
+	}
+
+	hash, err := hex.DecodeString(hdr.PAXRecords[ChunkHashKey])
+	if chunks == nil || err != nil || len(hash) == 0 {
+		report(hdr.Name, "Can't rebuild the chunks of this file; it will be stored again at the next backup")
+		return nil
+	}
+
+	size, err := strconv.ParseInt(hdr.PAXRecords[ChunkKey], 10, 64)
+	if err != nil {
+		report(hdr.Name, err.Error())
+		return nil
+	}
+
+	return rebuildEntry(seenDb, hdr, &SeenEntry{Mtime: hdr.ModTime, Size: size, Hash: hash}, chunks, report)
+}
+
+// (A file might turn up twice in an archive that didn't
+// come from a backup, which is a problem but not an error.)
+func rebuildEntry(seenDb *SeenDb, hdr *tar.Header, entry *SeenEntry, chunks []FileChunk, report func(string, string)) error {
+	existing, err := seenDb.GetEntry(hdr.Name, seenDb.E)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		report(hdr.Name, "Found more than once")
+		return nil
+	}
+
+	err = seenDb.AddEntry(hdr.Name, entry)
+	if err == nil && len(chunks) > 0 {
+		err = seenDb.SetFileChunks(hdr.Name, chunks)
+	}
+
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRebuildDb(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	// (The archives round this to the second.)
+	when := time.Date(2020, 1, 1, 0, 0, 0, 600000000, time.UTC)
+	j.Write("a", "contents of a")
+	j.Touch("a", when)
+	j.Write("b", "contents of b")
+	j.Backup()
+	j.Remove("b")
+	rebuilt := j.Backup()
+
+	err := os.Rename(j.R.GetDbFilename(), j.R.GetDbFilename()+".lost")
+	if err == nil {
+		err = j.R.DoRebuildDb(plainEncrypt{})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rebuilt editions don't know about deletions:
+	err = j.R.DoUnpack(new(Filters), j.Dir, new(Replacements), plainEncrypt{}, rebuilt, Unpack_Restore, nil)
+	if err == nil {
+		t.Errorf("Restored a rebuilt edition")
+	}
+
+	// Nothing has changed since, so the next backup reads
+	// nothing, but it does notice the deletion:
+	e := j.Backup()
+	seenDb, err := NewSeenDb(j.R.GetDbFilename(), plainEncrypt{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seenDb.Close()
+
+	list, err := seenDb.ListEditionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 3 || !list[1].IsRebuilt() || list[2].IsRebuilt() {
+		t.Fatalf("Found %d editions", len(list))
+	}
+
+	if list[2].BytesRead != 0 {
+		t.Errorf("Read %d bytes", list[2].BytesRead)
+	}
+
+	entry, err := seenDb.GetEntry(j.Src("a"), e)
+	if err != nil || entry != nil {
+		t.Errorf("Added %v (%v)", entry, err)
+	}
+
+	checkTree(t, "Restored", j.Restore(e), map[string]string{
+		"a": "contents of a",
+	})
+}
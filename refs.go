@@ -0,0 +1,54 @@
+/* References to contents in other archives.  A file whose
+ * contents are already archived, under whatever name, gets
+ * an entry with no contents of its own: just its mode etc,
+ * and these PAX records saying where the contents are.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"strconv"
+)
+
+const (
+	RefNameKey    = "KAIEKKRIN.backup.ref"
+	RefEditionKey = "KAIEKKRIN.backup.ref_edition"
+)
+
+func isRefHeader(hdr *tar.Header) bool {
+	_, found := hdr.PAXRecords[RefNameKey]
+	return found
+}
+
+func setRefHeader(hdr *tar.Header, ref string, refEdition *Edition) {
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+
+	hdr.PAXRecords[RefNameKey] = ref
+	hdr.PAXRecords[RefEditionKey] = strconv.FormatInt(refEdition.Unix(), 10)
+}
+
+// Makes a header for the contents that a reference
+// refers to, with the same mode etc.
+func clearRefHeader(hdr *tar.Header, size int64) *tar.Header {
+	return clearRecords(hdr, size, RefNameKey, RefEditionKey)
+}
+
+// Copies a header, giving it a new size and leaving out
+// the given PAX records.
+func clearRecords(hdr *tar.Header, size int64, keys ...string) *tar.Header {
+	cleared := *hdr
+	cleared.Size = size
+	cleared.PAXRecords = make(map[string]string)
+	for key, value := range hdr.PAXRecords {
+		cleared.PAXRecords[key] = value
+	}
+
+	for i := 0; i < len(keys); i++ {
+		delete(cleared.PAXRecords, keys[i])
+	}
+
+	return &cleared
+}
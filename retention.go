@@ -0,0 +1,68 @@
+/* Describes which editions to keep when pruning, by
+ * grandfather-father-son rules.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type Retention struct {
+	// How many of the most recent days, weeks, months
+	// and years to keep an edition from.
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+func (r *Retention) IsEmpty() bool {
+	return r.Daily <= 0 && r.Weekly <= 0 && r.Monthly <= 0 && r.Yearly <= 0
+}
+
+// Decides which of the (sorted) editions to keep.  We
+// keep the last edition in each of the most recent N days,
+// weeks, months and years that have any editions in them,
+// and the latest edition always.
+func (r *Retention) Keep(editions *SortedEditions) []bool {
+	rules := []struct {
+		Count  int
+		Period func(time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{r.Monthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+		{r.Yearly, func(t time.Time) string {
+			return t.Format("2006")
+		}},
+	}
+
+	keep := make([]bool, editions.Len())
+	for i := 0; i < len(rules); i++ {
+		kept := 0
+		lastPeriod := ""
+		for j := editions.Len() - 1; j >= 0 && kept < rules[i].Count; j-- {
+			period := rules[i].Period(editions.At(j).When)
+			if period != lastPeriod {
+				keep[j] = true
+				kept += 1
+				lastPeriod = period
+			}
+		}
+	}
+
+	if len(keep) > 0 {
+		keep[len(keep)-1] = true
+	}
+
+	return keep
+}
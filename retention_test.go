@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionKeep(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Retention Retention
+		Editions  []string
+		Keep      []bool
+	}{
+		{"no editions", Retention{Daily: 1}, nil, []bool{}},
+		{"no rules keeps the latest", Retention{},
+			[]string{"2020-01-01T10:00:00Z", "2020-01-02T10:00:00Z"},
+			[]bool{false, true}},
+		{"daily keeps the last of each day", Retention{Daily: 2},
+			[]string{"2020-01-01T10:00:00Z", "2020-01-01T12:00:00Z", "2020-01-02T09:00:00Z", "2020-01-03T08:00:00Z", "2020-01-03T20:00:00Z"},
+			[]bool{false, false, true, false, true}},
+		{"days without editions don't count", Retention{Daily: 2},
+			[]string{"2020-01-01T10:00:00Z", "2020-01-05T10:00:00Z", "2020-01-09T10:00:00Z"},
+			[]bool{false, true, true}},
+		{"weeks span the new year", Retention{Weekly: 2},
+			[]string{"2020-12-21T10:00:00Z", "2020-12-28T10:00:00Z", "2021-01-03T10:00:00Z", "2021-01-04T10:00:00Z"},
+			[]bool{false, false, true, true}},
+		{"monthly", Retention{Monthly: 2},
+			[]string{"2020-01-05T10:00:00Z", "2020-01-20T10:00:00Z", "2020-02-03T10:00:00Z", "2020-03-01T10:00:00Z"},
+			[]bool{false, false, true, true}},
+		{"yearly", Retention{Yearly: 2},
+			[]string{"2019-12-31T10:00:00Z", "2020-06-01T10:00:00Z", "2020-12-31T10:00:00Z", "2021-01-01T10:00:00Z"},
+			[]bool{false, false, true, true}},
+		{"rules add up", Retention{Daily: 1, Monthly: 3},
+			[]string{"2020-01-05T10:00:00Z", "2020-02-03T10:00:00Z", "2020-03-01T10:00:00Z", "2020-03-01T12:00:00Z"},
+			[]bool{true, true, false, true}},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		editions := &SortedEditions{}
+		for j := 0; j < len(tests[i].Editions); j++ {
+			when, err := time.Parse(time.RFC3339, tests[i].Editions[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			editions.Append(&Edition{when})
+		}
+
+		keep := tests[i].Retention.Keep(editions)
+		if !reflect.DeepEqual(keep, tests[i].Keep) {
+			t.Errorf("%s : Kept %v, expected %v", tests[i].Name, keep, tests[i].Keep)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/* The layout of the seen database, and how to bring an
+ * older database up to it.  Each migration takes the
+ * database from one schema version to the next, and the
+ * schema_version table records the ones it has had.
+ * Databases from before we kept a version are version 0,
+ * whatever they already have, so the early migrations
+ * only add what's missing.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+type migration struct {
+	Description string
+	Apply       func(*sql.Tx) error
+}
+
+// In order; never change one that's been released, add
+// another instead.
+var migrations = []migration{
+	{"files", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`create table if not exists files(
+            filename text,
+            edition integer,
+            mtime integer,
+            hash text,
+            primary key (filename, edition))`)
+	}},
+
+	{"hard links", func(tx *sql.Tx) error {
+		return addColumn(tx, "files", "link", "text not null default ''")
+	}},
+
+	{"references to other files' contents", func(tx *sql.Tx) error {
+		err := addColumn(tx, "files", "ref", "text not null default ''")
+		if err == nil {
+			err = addColumn(tx, "files", "ref_edition", "integer not null default 0")
+		}
+
+		return err
+	}},
+
+	// We look contents up by hash:
+	{"hash index and checkpoints", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`create index if not exists files_hash on files(hash)`,
+			`create table if not exists checkpoints(
+            edition integer primary key,
+            segments integer)`)
+	}},
+
+	// Chunks of large files, and the editions whose
+	// archives hold them:
+	{"chunks", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`create table if not exists chunks(
+            hash text primary key,
+            edition integer,
+            size integer)`,
+			`create table if not exists file_chunks(
+            filename text,
+            edition integer,
+            seq integer,
+            start integer,
+            hash text,
+            primary key (filename, edition, seq))`,
+			`create index if not exists file_chunks_hash on file_chunks(hash)`)
+	}},
+
+	// For telling whether a file might have changed:
+	{"file metadata", func(tx *sql.Tx) error {
+		columns := []string{"mtime_nsec", "size", "ctime", "inode"}
+		for i := 0; i < len(columns); i++ {
+			err := addColumn(tx, "files", columns[i], "integer not null default 0")
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}},
+
+	{"unstable files", func(tx *sql.Tx) error {
+		return addColumn(tx, "files", "unstable", "integer not null default 0")
+	}},
+
+	// What each backup run did.  The editions we already
+	// have get no statistics:
+	{"editions", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`create table if not exists editions(
+            edition integer primary key,
+            start_time integer not null default 0,
+            end_time integer not null default 0,
+            hostname text not null default '',
+            job text not null default '',
+            prefix text not null default '',
+            scanned integer not null default 0,
+            added integer not null default 0,
+            failed integer not null default 0,
+            bytes_read integer not null default 0,
+            bytes_stored integer not null default 0)`,
+			`insert or ignore into editions (edition) select distinct edition from files`)
+	}},
+
+	{"unstable file counts", func(tx *sql.Tx) error {
+		return addColumn(tx, "editions", "unstable", "integer not null default 0")
+	}},
+
+	// How far the walk had got, so that resuming doesn't
+	// archive the directories before it again:
+	{"checkpoint progress", func(tx *sql.Tx) error {
+		return addColumn(tx, "checkpoints", "last_path", "text not null default ''")
+	}},
+
+	// Entries rebuilt from the archives, which don't have
+	// all their metadata:
+	{"rebuilt files", func(tx *sql.Tx) error {
+		return addColumn(tx, "files", "rebuilt", "integer not null default 0")
+	}},
+}
+
+// The version that this program's databases have.
+func schemaVersion() int {
+	return len(migrations)
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for i := 0; i < len(statements); i++ {
+		_, err := tx.Exec(statements[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Adds a column to a table, unless it has one already.
+func addColumn(tx *sql.Tx, table string, column string, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf(`pragma table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if name == column {
+			found = true
+		}
+	}
+
+	err = rows.Close()
+	if err != nil || found {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`alter table %s add column %s %s`, table, column, definition))
+	return err
+}
+
+// Brings the database up to date, returning the version
+// it had before.
+func migrateDb(db *sql.DB) (int, error) {
+	// (A new database just gets created; there's nothing
+	// to tell anyone about.)
+	tables := 0
+	err := db.QueryRow(`select count(*) from sqlite_master where type='table'`).Scan(&tables)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.Exec(
+		`create table if not exists schema_version(
+        version integer primary key,
+        description text not null,
+        applied integer not null)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = db.QueryRow(`select max(version) from schema_version`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	from := int(version.Int64)
+	if from > schemaVersion() {
+		return from, errors.New(fmt.Sprintf("Database schema version %d is newer than this program's (%d)", from, schemaVersion()))
+	}
+
+	for v := from + 1; v <= schemaVersion(); v++ {
+		if tables > 0 {
+			fmt.Printf("Upgrading database to schema version %d (%s)\n", v, migrations[v-1].Description)
+		}
+
+		err = applyMigration(db, v)
+		if err != nil {
+			return from, errors.New(fmt.Sprintf("Schema version %d : %s", v, err.Error()))
+		}
+	}
+
+	return from, nil
+}
+
+// Each migration happens entirely or not at all.
+func applyMigration(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = migrations[version-1].Apply(tx)
+	if err == nil {
+		_, err = tx.Exec(`insert into schema_version values (?, ?, ?)`, version, migrations[version-1].Description, time.Now().Unix())
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The copy we keep of a database before writing over it
+// with a newer schema.
+func oldVersionFilename(filename string, version int) string {
+	return fmt.Sprintf("%s.schema%d", filename, version)
+}
+
+// Copies the (encrypted) database file as it is, if it
+// exists.
+func keepOldVersion(filename string, version int) error {
+	src, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fmt.Printf("Keeping a copy of the schema version %d database as %s\n", version, oldVersionFilename(filename, version))
+	return writeAtomically(oldVersionFilename(filename, version), func(dst *os.File) error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
+}
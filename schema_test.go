@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestDb(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "seen.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func listColumns(t *testing.T, db *sql.DB, table string) []string {
+	rows, err := db.Query(`select name from pragma_table_info(?) order by cid`, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		columns = append(columns, column)
+	}
+
+	return columns
+}
+
+// A database from before we kept a schema version.
+func TestMigrateVersion0(t *testing.T) {
+	db, done := openTestDb(t)
+	defer done()
+
+	for _, statement := range []string{
+		`create table files(
+            filename text,
+            edition integer,
+            mtime integer,
+            hash text,
+            primary key (filename, edition))`,
+		`alter table files add column link text not null default ''`,
+		`insert into files (filename, edition, mtime, hash, link) values ('a', 100, 90, 'aGFzaA==', '')`,
+		`insert into files (filename, edition, mtime, hash, link) values ('b', 200, 190, 'aGFzaA==', 'a')`,
+	} {
+		_, err := db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, err := migrateDb(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if from != 0 {
+		t.Errorf("Migrated from version %d, expected 0", from)
+	}
+
+	expected := []string{"filename", "edition", "mtime", "hash", "link", "ref", "ref_edition", "mtime_nsec", "size", "ctime", "inode", "unstable", "rebuilt"}
+	if columns := listColumns(t, db, "files"); !reflect.DeepEqual(columns, expected) {
+		t.Errorf("Files has columns %v, expected %v", columns, expected)
+	}
+
+	var version, applied int
+	err = db.QueryRow(`select max(version), count(*) from schema_version`).Scan(&version, &applied)
+	if err != nil || version != schemaVersion() || applied != schemaVersion() {
+		t.Errorf("Recorded version %d in %d migrations (%v)", version, applied, err)
+	}
+
+	// The files are as they were, with defaults:
+	var link, ref string
+	var refEdition, size, unstable int
+	err = db.QueryRow(`select link, ref, ref_edition, size, unstable from files where filename='b'`).Scan(&link, &ref, &refEdition, &size, &unstable)
+	if err != nil || link != "a" || ref != "" || refEdition != 0 || size != 0 || unstable != 0 {
+		t.Errorf("Found link %s, ref %s, ref edition %d, size %d, unstable %d (%v)", link, ref, refEdition, size, unstable, err)
+	}
+
+	// Each edition gets a row, with nothing known about it:
+	var editions, known int
+	err = db.QueryRow(`select count(*), count(nullif(end_time, 0)) from editions`).Scan(&editions, &known)
+	if err != nil || editions != 2 || known != 0 {
+		t.Errorf("Found %d editions, %d known (%v)", editions, known, err)
+	}
+
+	// Once it's up to date, there's nothing more to do:
+	from, err = migrateDb(db)
+	if err != nil || from != schemaVersion() {
+		t.Errorf("Migrated again from version %d (%v)", from, err)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	db, done := openTestDb(t)
+	defer done()
+
+	_, err := migrateDb(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`insert into schema_version values (?, 'from the future', 0)`, schemaVersion()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = migrateDb(db)
+	if err == nil {
+		t.Errorf("Accepted a newer database")
+	}
+}
+
+func TestAddColumn(t *testing.T) {
+	db, done := openTestDb(t)
+	defer done()
+
+	_, err := db.Exec(`create table t(a text, b integer)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Column  string
+		Columns []string
+	}{
+		{"c", []string{"a", "b", "c"}},
+		// (Already there.)
+		{"b", []string{"a", "b", "c"}},
+		{"c", []string{"a", "b", "c"}},
+		{"d", []string{"a", "b", "c", "d"}},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = addColumn(tx, "t", tests[i].Column, "integer not null default 0")
+		if err != nil {
+			tx.Rollback()
+			t.Fatalf("%s : %s", tests[i].Column, err.Error())
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if columns := listColumns(t, db, "t"); !reflect.DeepEqual(columns, tests[i].Columns) {
+			t.Errorf("%s : Have columns %v, expected %v", tests[i].Column, columns, tests[i].Columns)
+		}
+	}
+}
+
+// Only commands that change the database write back an
+// upgraded one.
+func TestUpgradeWrittenBack(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	j.Write("a", "contents of a")
+	j.Backup()
+
+	// (The test encryption leaves the database as it is.)
+	old := schemaVersion() - 1
+	db, err := sql.Open("sqlite3", j.R.GetDbFilename())
+	if err == nil {
+		_, err = db.Exec(`delete from schema_version where version>?`, old)
+		db.Close()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := ioutil.ReadFile(j.R.GetDbFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.Restore(nil)
+	err = j.R.DoStats(plainEncrypt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ioutil.ReadFile(j.R.GetDbFilename())
+	if err != nil || !bytes.Equal(after, before) {
+		t.Errorf("Reading the database changed it (%v)", err)
+	}
+
+	if _, err = os.Stat(oldVersionFilename(j.R.GetDbFilename(), old)); !os.IsNotExist(err) {
+		t.Errorf("Kept a copy of the old version after reading it (%v)", err)
+	}
+
+	// Backing up keeps the upgrade, and the old version:
+	j.Backup()
+	kept, err := ioutil.ReadFile(oldVersionFilename(j.R.GetDbFilename(), old))
+	if err != nil || !bytes.Equal(kept, before) {
+		t.Errorf("Didn't keep the old version (%v)", err)
+	}
+
+	db, err = sql.Open("sqlite3", j.R.GetDbFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	err = db.QueryRow(`select max(version) from schema_version`).Scan(&version)
+	if err != nil || version != schemaVersion() {
+		t.Errorf("Upgraded to version %d (%v)", version, err)
+	}
+}
@@ -10,17 +10,260 @@ import (
 
 type Seen interface {
 	// Includes the file in the new edition of the backup
-	// if required, using the supplied function.
-	// (filename, mtime, hash function, include function).
-	Update(string, time.Time, func() ([]byte, error), func() error) error
+	// if required, using the supplied function -- or if an
+	// archive already has the same contents, using the
+	// reference function with that file and its edition.
+	// Whether the file needs reading at all depends on the
+	// change detection policy.  The read function is told
+	// whether the contents may go straight into the archive
+	// as they're read, which is only the case if they must
+	// have changed.
+	// (filename, metadata, read function, include function,
+	// reference function).
+	Update(string, *FileMeta, func(bool) (*FileRead, error), func() error, func(string, *Edition) error) error
 
-	// Lists the editions in the database.
-	ListEditions() (*SortedEditions, error)
+	// Tells whether Update would want the file's hash, and
+	// the hash it would compare it with (nil if none).
+	// Files sharing another's contents are no different.
+	// (filename, metadata).
+	CheckUpdate(string, *FileMeta) (bool, []byte, error)
+
+	// Includes the file in the new edition of the backup
+	// as a hard link to another file, if it isn't one
+	// already, using the supplied function.  The other file
+	// must have been passed to Update first.
+	// (filename, metadata, link target, include function).
+	UpdateLink(string, *FileMeta, string, func() error) error
+
+	// Adds an entry for a file to the new edition as it
+	// is, for rebuilding the database from the archives
+	// (which is recorded with it).
+	// (filename, entry).
+	AddEntry(string, *SeenEntry) error
+
+	// Gets the most recent entry for a file as of the
+	// given edition (or the latest, if nil), or nil if
+	// the file hadn't been seen by then.
+	GetLatest(string, *Edition) (*SeenEntry, error)
+
+	// Gets the entry for a file in exactly the given
+	// edition, or nil if there isn't one.
+	GetEntry(string, *Edition) (*SeenEntry, error)
+
+	// Calls the function for every entry up to the given
+	// edition (or all of them, if nil).
+	ListEntries(*Edition, func(string, *SeenEntry) error) error
+
+	// Calls the function with the most recent entry for
+	// every file as of the given edition (or the latest,
+	// if nil).
+	ListLatest(*Edition, func(string, *SeenEntry) error) error
+
+	// Records, in the new edition, the deletion of every
+	// file that is still live in the database, that
+	// hasn't been passed to Update and for which the
+	// supplied function returns true.
+	MarkDeleted(func(string) bool) error
+
+	// Records a chunk of a large file, including it in
+	// the new edition of the backup (using the supplied
+	// function) if no edition has it yet.
+	// (hash, size, include function).
+	AddChunk(string, int64, func() error) error
+
+	// Records the chunks that a file in the new edition
+	// is made of.
+	SetFileChunks(string, []FileChunk) error
+
+	// Calls the function with each chunk of each file
+	// that is stored in chunks, in order, as of the given
+	// edition (or the latest, if nil).
+	ListLatestChunks(*Edition, func(string, *FileChunk) error) error
+
+	// Calls the function with every chunk in an edition
+	// up to the given one (or all of them, if nil).
+	ListChunks(*Edition, func(string, *Edition) error) error
+
+	// Records what the backup run that made my edition
+	// did.
+	RecordEdition(*EditionStats) error
+
+	// Lists the editions in the database, in order, with
+	// what is known about each one.
+	ListEditionStats() ([]*EditionStats, error)
+
+	// Lists the editions holding the files that were live
+	// as of the given edition (or the latest, if nil).
+	ListNeededEditions(*Edition) (*SortedEditions, error)
 
 	// Removes editions later than the given one from
 	// the database.
 	RemoveEditionsAfter(*Edition) error
 
+	// Merges the first edition into the second, later one:
+	// its entries that are still current as of the second
+	// edition move into it, and the rest are removed.
+	// Returns the names of the live files and chunks that
+	// moved (whose contents therefore need to move too), and the
+	// removed files whose contents are still referred to
+	// (which need copying into the referring edition).
+	// Hard links that would no longer find their contents
+	// become files of their own, and get a copy too.
+	MergeEdition(*Edition, *Edition) ([]string, []RefCopy, error)
+
+	// Commits everything so far and writes a copy of the
+	// database to the given file, recording the number of
+	// archive segments complete and the last path in them.
+	Checkpoint(string, int, string) error
+
 	// Closes stuff.
 	Close() error
+
+	// Closes stuff, throwing away any changes.
+	Abort() error
+}
+
+// Ways of telling whether a file might have changed, and
+// so needs hashing: if its mtime has changed; if any of
+// its metadata has; or always.
+const (
+	Detect_Mtime    = "mtime"
+	Detect_Metadata = "metadata"
+	Detect_Always   = "always"
+)
+
+// What Update's read function found out about a file.
+type FileRead struct {
+	Hash []byte
+
+	// The file's metadata as it was when we read it, which
+	// might not be how it was when we first looked.
+	Meta *FileMeta
+
+	// Whether the contents went straight into the archive
+	// as we read them.  If so, they're recorded as they are,
+	// even if they haven't changed.
+	Archived bool
+
+	// Whether the file kept changing while we read it.
+	// Such a file is always recorded (and flagged), since
+	// what we have of it might not be consistent.
+	// If the include function has to read the file again
+	// and finds it changed, it updates this and the hash.
+	Unstable bool
+}
+
+// What we know about a file without reading it.
+type FileMeta struct {
+	Mtime time.Time
+	Size  int64
+
+	// (Zero where the platform doesn't have them.)
+	Ctime time.Time
+	Inode uint64
+}
+
+// One entry in the seen database.
+type SeenEntry struct {
+	E     *Edition
+	Mtime time.Time
+
+	// The rest of the file's metadata.  (Entries from
+	// before we recorded it have zeroes.)
+	Size  int64
+	Ctime time.Time
+	Inode uint64
+
+	// The file's hash, or nil if this entry records the
+	// file's deletion.
+	Hash []byte
+
+	// The file this one is a hard link to, if any.
+	Link string
+
+	// The file, and its edition, whose archived contents
+	// this one shares, if any.
+	Ref  string
+	RefE *Edition
+
+	// Whether this entry was rebuilt from an archive, whose
+	// headers only have the mtime to the nearest second,
+	// and no ctime or inode.
+	Rebuilt bool
+}
+
+func (e *SeenEntry) IsDeleted() bool {
+	return e.Hash == nil
+}
+
+// Tells whether the file's mtime is the same as it was for
+// this entry, as far as we know it.
+func (e *SeenEntry) SameMtime(mtime time.Time) bool {
+	if e.Rebuilt {
+		return e.Mtime.Equal(mtime.Round(time.Second))
+	}
+
+	return e.Mtime.Equal(mtime)
+}
+
+// Tells whether the file's metadata are the same as they
+// were for this entry (as far as we know them).
+func (e *SeenEntry) SameMeta(meta *FileMeta) bool {
+	if e.Rebuilt {
+		return e.SameMtime(meta.Mtime) && e.Size == meta.Size
+	}
+
+	return e.Mtime.Equal(meta.Mtime) && e.Size == meta.Size && e.Ctime.Equal(meta.Ctime) && e.Inode == meta.Inode
+}
+
+// Contents that need copying from the archive of an edition
+// (usually one being removed) into the archive of the file
+// referring to them, which will hold them from now on.
+type RefCopy struct {
+	Source   string
+	Filename string
+	E        *Edition
+
+	// The edition whose archive has the source.
+	SourceE *Edition
+}
+
+// What the backup run that made an edition did.  (A
+// resumed backup only counts what it did after resuming;
+// editions from before we kept these have zeroes, and
+// rebuilt ones only the files added and bytes stored.)
+type EditionStats struct {
+	E *Edition
+
+	Start    time.Time
+	End      time.Time
+	Hostname string
+	JobPath  string
+	Prefix   string
+
+	Scanned  int64
+	Added    int64
+	Failed   int64
+	Unstable int64
+
+	// How much we read from the files, and the size of
+	// the archive.
+	BytesRead   int64
+	BytesStored int64
+}
+
+// Tells whether the edition's entries were rebuilt from
+// its archive, rather than recorded by a backup.
+func (s *EditionStats) IsRebuilt() bool {
+	return s.End.IsZero() && s.BytesStored > 0
+}
+
+// One chunk of a file stored in chunks.
+type FileChunk struct {
+	Hash  string
+	Start int64
+	Size  int64
+
+	// The edition holding the chunk.
+	E *Edition
 }
@@ -5,10 +5,12 @@ package main
 import (
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"reflect"
 	"sort"
@@ -19,91 +21,481 @@ type SeenDb struct {
 	Db *sql.DB
 	E  *Edition // My current edition
 
-	// For performance, we'll retain a single transaction.
-	// TODO : Should I commit it and recreate it every now and
-	// again to avoid devouring loads of memory?
+	// For performance, we'll retain a single transaction,
+	// committing it only at checkpoints.
 	Tx *SeenTransaction
 
+	// The files passed to Update during this run, so that
+	// we can work out which ones have been deleted:
+	Seen map[string]struct{}
+
+	// Whether anything has changed.  If not, there's no
+	// need to write the database back out when we close it:
+	Modified bool
+
 	// For re-encrypting the database when done:
 	Enc      Encrypt
 	TempFile string
 	Filename string
+
+	// How Update tells whether a file might have changed
+	// (one of the Detect_ values; defaults to mtime).
+	ChangeDetection string
+
+	// How many files Update and UpdateLink have added to
+	// my edition.
+	Added int64
+
+	// The schema version the database file has, so that we
+	// can keep a copy of an older one before replacing it.
+	Version int
 }
 
-func (d *SeenDb) Update(filename string, mtimeNow time.Time, getHash func() ([]byte, error), includeFile func() error) (err error) {
-	mtimeNowUnix := mtimeNow.Unix()
+func (d *SeenDb) Update(filename string, meta *FileMeta, readFile func(bool) (*FileRead, error), includeFile func() error, includeRef func(string, *Edition) error) (err error) {
+	d.Seen[filename] = struct{}{}
 
-	// Find the most recent entry for this file:
-	var mtimeThenUnix int64
-	hashStr := ""
-	err = func() error {
-		rows, err := d.Tx.GetLatestMtimeHash.Query(filename)
+	needed, previous, err := d.checkUpdate(filename, meta)
+	if err != nil {
+		return
+	}
+
+	// A hard link that comes here is a file on its own now
+	// (its target has gone, say), so its contents can't stay
+	// in its target, which might change.  If they're still
+	// archived, it can share them:
+	if !needed && previous != nil && previous.Link != "" {
+		hashStr := base64.StdEncoding.EncodeToString(previous.Hash)
+		ref, refEdition, err := d.findContent(hashStr)
 		if err != nil {
 			return err
 		}
 
-		defer rows.Close()
-		if rows.Next() {
-			err = rows.Scan(&mtimeThenUnix, &hashStr)
+		if ref != "" {
+			err = includeRef(ref, refEdition)
+			if err == nil {
+				err = d.insertEntry(filename, meta, hashStr, "", ref, refEdition.Unix(), false, false)
+			}
+
+			return err
 		}
 
-		return err
-	}()
+		needed = true
+	}
+
+	if !needed {
+		return
+	}
 
+	// Contents that are new (or a new size) might as well
+	// be archived as they're read; otherwise we want to
+	// find out whether we have them already first:
+	read, err := readFile(previous == nil || previous.Size != meta.Size)
 	if err != nil {
 		return
 	}
 
-	var hashThen, hashNow []byte
-	if hashStr != "" {
-		// There is an entry for this file.
-		// If this file is up to date, we clearly don't
-		// need a new edition:
-		if mtimeNowUnix <= mtimeThenUnix {
-			return
-		}
+	if read.Meta != nil {
+		meta = read.Meta
+	}
 
-		// Check the hashes; we only need a new edition if
-		// the hash has changed
-		hashThen, err = base64.StdEncoding.DecodeString(hashStr)
-		if err != nil {
-			return
-		}
+	// (There's no taking back what's in the archive.)
+	hashNow := read.Hash
+	if read.Archived {
+		return d.insertEntry(filename, meta, base64.StdEncoding.EncodeToString(hashNow), "", "", 0, read.Unstable, false)
 	}
 
-	hashNow, err = getHash()
-	if err != nil {
+	// Check the hashes; we only need a new edition if
+	// the hash has changed (or the file wouldn't keep
+	// still, which we want on record) -- or if the
+	// metadata have, so that we don't hash it again next
+	// time.  (The earlier editions keep theirs.)  Then it
+	// can share the contents it had:
+	if previous != nil && !read.Unstable && reflect.DeepEqual(hashNow, previous.Hash) && previous.SameMeta(meta) {
 		return
 	}
 
-	if reflect.DeepEqual(hashNow, hashThen) {
+	// If we've archived these contents already, under
+	// whatever name, refer to them there:
+	hashStr := base64.StdEncoding.EncodeToString(hashNow)
+	ref, refEdition, err := d.findContent(hashStr)
+	if err != nil {
 		return
 	}
 
-	// Include the file:
-	err = includeFile()
+	refEditionUnix := int64(0)
+	if ref != "" {
+		err = includeRef(ref, refEdition)
+		refEditionUnix = refEdition.Unix()
+	} else {
+		// (If it had to read the file again, that might
+		// have changed the hash.)
+		err = includeFile()
+		hashStr = base64.StdEncoding.EncodeToString(read.Hash)
+	}
+
 	if err != nil {
 		return
 	}
 
 	// We included the file successfully, update
 	// the database:
-	_, err = d.Tx.InsertNewEdition.Exec(
+	return d.insertEntry(filename, meta, hashStr, "", ref, refEditionUnix, read.Unstable, false)
+}
+
+func (d *SeenDb) AddEntry(filename string, entry *SeenEntry) error {
+	hashStr := ""
+	if entry.Hash != nil {
+		hashStr = base64.StdEncoding.EncodeToString(entry.Hash)
+	}
+
+	refEditionUnix := int64(0)
+	if entry.RefE != nil {
+		refEditionUnix = entry.RefE.Unix()
+	}
+
+	return d.insertEntry(filename, &FileMeta{entry.Mtime, entry.Size, entry.Ctime, entry.Inode}, hashStr, entry.Link, entry.Ref, refEditionUnix, false, true)
+}
+
+// Inserts an entry for a file into the new edition.
+func (d *SeenDb) insertEntry(filename string, meta *FileMeta, hashStr string, link string, ref string, refEditionUnix int64, unstable bool, rebuilt bool) error {
+	unstableInt, rebuiltInt := 0, 0
+	if unstable {
+		unstableInt = 1
+	}
+
+	if rebuilt {
+		rebuiltInt = 1
+	}
+
+	_, err := d.Tx.InsertNewEdition.Exec(
 		filename,
 		d.E.Unix(),
-		mtimeNowUnix,
-		base64.StdEncoding.EncodeToString(hashNow))
+		meta.Mtime.Unix(),
+		meta.Mtime.Nanosecond(),
+		meta.Size,
+		timeOrZero(meta.Ctime),
+		int64(meta.Inode),
+		hashStr,
+		link,
+		ref,
+		refEditionUnix,
+		unstableInt,
+		rebuiltInt)
+	if err == nil {
+		d.Added += 1
+	}
+
+	d.Modified = true
+	return err
+}
+
+// Finds a file whose contents, with this hash, are in an
+// archive.  Returns a blank name if there isn't one.
+func (d *SeenDb) findContent(hashStr string) (filename string, edition *Edition, err error) {
+	rows, err := d.Tx.FindContent.Query(hashStr)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var editionUnix int64
+		err = rows.Scan(&filename, &editionUnix)
+		edition = EditionFromUnix(editionUnix)
+	}
+
+	return filename, edition, err
+}
+
+func (d *SeenDb) CheckUpdate(filename string, meta *FileMeta) (needed bool, hashThen []byte, err error) {
+	needed, previous, err := d.checkUpdate(filename, meta)
+	if previous != nil {
+		hashThen = previous.Hash
+	}
+
+	return needed, hashThen, err
+}
+
+// Also returns the live entry with the file's previous
+// contents, if there is one.
+func (d *SeenDb) checkUpdate(filename string, meta *FileMeta) (needed bool, previous *SeenEntry, err error) {
+	// Find the most recent entry for this file:
+	entry, err := d.GetLatest(filename, nil)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// If we resumed from a checkpoint, we might already
+	// have included this file in my edition:
+	if entry != nil && entry.E.Unix() == d.E.Unix() {
+		return false, nil, nil
+	}
+
+	if entry == nil || entry.IsDeleted() {
+		return true, nil, nil
+	}
+
+	// There is a live entry for this file (which might
+	// share its contents with another, but still has their
+	// hash).  If this file is up to date, we clearly don't
+	// need a new edition:
+	switch d.ChangeDetection {
+	case Detect_Always:
+		needed = true
+
+	case Detect_Metadata:
+		needed = !entry.SameMeta(meta)
+
+	default:
+		needed = !entry.SameMtime(meta.Mtime)
+	}
+
+	return needed, entry, nil
+}
+
+func (d *SeenDb) UpdateLink(filename string, meta *FileMeta, target string, includeLink func() error) (err error) {
+	d.Seen[filename] = struct{}{}
+
+	entry, err := d.GetLatest(filename, nil)
+	if err != nil {
+		return
+	}
+
+	// If it's still the same link, there's nothing to do.
+	// (Nor if we've done it already, before a checkpoint
+	// we resumed from.)
+	if entry != nil && (entry.E.Unix() == d.E.Unix() || (!entry.IsDeleted() && entry.Link == target)) {
+		return
+	}
+
+	// The link shares its contents, and so its hash, with
+	// the target:
+	targetEntry, err := d.GetLatest(target, nil)
+	if err != nil {
+		return
+	}
+
+	if targetEntry == nil || targetEntry.IsDeleted() {
+		return errors.New(fmt.Sprintf("Link target %s not in database", target))
+	}
+
+	err = includeLink()
+	if err != nil {
+		return
+	}
+
+	return d.insertEntry(filename, meta, base64.StdEncoding.EncodeToString(targetEntry.Hash), target, "", 0, false, false)
+}
+
+// Converts an edition to search up to, where nil means
+// the latest one.
+func asOfUnix(asOf *Edition) int64 {
+	if asOf == nil {
+		return math.MaxInt64
+	}
+
+	return asOf.Unix()
+}
+
+func (d *SeenDb) GetLatest(filename string, asOf *Edition) (entry *SeenEntry, err error) {
+	rows, err := d.Tx.GetLatest.Query(filename, asOfUnix(asOf))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		entry, err = scanEntry(rows)
+	}
+
+	return entry, err
+}
+
+func (d *SeenDb) GetEntry(filename string, edition *Edition) (entry *SeenEntry, err error) {
+	rows, err := d.Tx.GetEntry.Query(filename, edition.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		entry, err = scanEntry(rows)
+	}
+
+	return entry, err
+}
+
+func (d *SeenDb) ListEntries(asOf *Edition, list func(string, *SeenEntry) error) error {
+	rows, err := d.Tx.ListEntries.Query(asOfUnix(asOf))
+	if err != nil {
+		return err
+	}
+
+	return listRows(rows, list)
+}
+
+func (d *SeenDb) ListLatest(asOf *Edition, list func(string, *SeenEntry) error) error {
+	rows, err := d.Tx.ListLatest.Query(asOfUnix(asOf))
+	if err != nil {
+		return err
+	}
+
+	return listRows(rows, list)
+}
+
+// Calls the function for each row of (filename, edition,
+// mtime, hash, link, ref, ref edition), and closes the rows.
+func listRows(rows *sql.Rows, list func(string, *SeenEntry) error) (err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		filename := ""
+		var entry *SeenEntry
+		entry, err = scanEntry(rows, &filename)
+		if err != nil {
+			return err
+		}
+
+		err = list(filename, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads an entry from a row of (leading columns...,
+// edition, mtime, mtime nsec, size, ctime, inode, hash,
+// link, ref, ref edition, rebuilt).
+func scanEntry(rows *sql.Rows, leading ...interface{}) (*SeenEntry, error) {
+	var editionUnix, mtimeUnix, mtimeNsec, size, ctimeNs, inode, refEditionUnix, rebuilt int64
+	hashStr, link, ref := "", "", ""
+	err := rows.Scan(append(leading, &editionUnix, &mtimeUnix, &mtimeNsec, &size, &ctimeNs, &inode, &hashStr, &link, &ref, &refEditionUnix, &rebuilt)...)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &SeenEntry{EditionFromUnix(editionUnix), time.Unix(mtimeUnix, mtimeNsec), size, time.Time{}, uint64(inode), nil, link, ref, nil, rebuilt != 0}
+	if ctimeNs != 0 {
+		entry.Ctime = time.Unix(0, ctimeNs)
+	}
+
+	if ref != "" {
+		entry.RefE = EditionFromUnix(refEditionUnix)
+	}
+
+	// A blank hash marks a deletion:
+	if hashStr != "" {
+		entry.Hash, err = base64.StdEncoding.DecodeString(hashStr)
+	}
+
+	return entry, err
+}
+
+func (d *SeenDb) MarkDeleted(isDeleted func(string) bool) (err error) {
+	// Gather up the deleted files first, so that we
+	// aren't inserting rows whilst still reading them:
+	var deleted []string
+	err = d.ListLatest(nil, func(filename string, entry *SeenEntry) error {
+		// (Anything already in my edition was there when we
+		// got to it, before a checkpoint we resumed from.)
+		if _, seen := d.Seen[filename]; !entry.IsDeleted() && !seen && entry.E.Unix() != d.E.Unix() && isDeleted(filename) {
+			deleted = append(deleted, filename)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < len(deleted); i++ {
+		fmt.Printf("%s : Deleted\n", deleted[i])
+		_, err = d.Tx.InsertNewEdition.Exec(deleted[i], d.E.Unix(), 0, 0, 0, 0, 0, "", "", "", 0, 0, 0)
+		if err != nil {
+			return
+		}
+
+		d.Modified = true
+	}
+
 	return
 }
 
-func (d *SeenDb) ListEditions() (editions *SortedEditions, err error) {
-	editionsUnixMap := make(map[int64]struct{})
+func (d *SeenDb) RecordEdition(stats *EditionStats) error {
+	d.Modified = true
+	_, err := d.Tx.RecordEdition.Exec(
+		d.E.Unix(),
+		timeOrZero(stats.Start),
+		timeOrZero(stats.End),
+		stats.Hostname,
+		stats.JobPath,
+		stats.Prefix,
+		stats.Scanned,
+		stats.Added,
+		stats.Failed,
+		stats.Unstable,
+		stats.BytesRead,
+		stats.BytesStored)
+	return err
+}
 
+func (d *SeenDb) ListEditionStats() (list []*EditionStats, err error) {
+	rows, err := d.Tx.ListEditionStats.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var editionUnix, startUnix, endUnix int64
+		stats := new(EditionStats)
+		err = rows.Scan(&editionUnix, &startUnix, &endUnix, &stats.Hostname, &stats.JobPath, &stats.Prefix, &stats.Scanned, &stats.Added, &stats.Failed, &stats.Unstable, &stats.BytesRead, &stats.BytesStored)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.E = EditionFromUnix(editionUnix)
+		if startUnix != 0 {
+			stats.Start = time.Unix(0, startUnix)
+		}
+
+		if endUnix != 0 {
+			stats.End = time.Unix(0, endUnix)
+		}
+
+		list = append(list, stats)
+	}
+
+	return list, nil
+}
+
+// In unix nanoseconds, or 0 for the zero time (which
+// UnixNano can't represent).
+func timeOrZero(when time.Time) int64 {
+	if when.IsZero() {
+		return 0
+	}
+
+	return when.UnixNano()
+}
+
+func (d *SeenDb) ListNeededEditions(asOf *Edition) (editions *SortedEditions, err error) {
 	var rows *sql.Rows
-	rows, err = d.Tx.ListEditions.Query()
+	rows, err = d.Tx.ListNeededEditions.Query(asOfUnix(asOf), asOfUnix(asOf), asOfUnix(asOf))
 	if err != nil {
 		return
 	}
+
+	return scanEditions(rows)
+}
+
+// Reads a set of edition numbers, which may contain
+// duplicates, and closes the rows.
+func scanEditions(rows *sql.Rows) (editions *SortedEditions, err error) {
+	editionsUnixMap := make(map[int64]struct{})
 	defer rows.Close()
 
 	for rows.Next() {
@@ -126,44 +518,419 @@ func (d *SeenDb) ListEditions() (editions *SortedEditions, err error) {
 }
 
 func (d *SeenDb) RemoveEditionsAfter(edition *Edition) (err error) {
+	d.Modified = true
 	_, err = d.Tx.RemoveEditionsAfter.Exec(edition.Unix())
+	if err == nil {
+		_, err = d.Tx.Tx.Exec(`delete from editions where edition>?`, edition.Unix())
+	}
+
+	if err == nil {
+		_, err = d.Tx.Tx.Exec(`delete from file_chunks where edition>?`, edition.Unix())
+	}
+
+	if err == nil {
+		_, err = d.Tx.Tx.Exec(`delete from chunks where edition>?`, edition.Unix())
+	}
+
+	return err
+}
+
+func (d *SeenDb) AddChunk(hash string, size int64, includeChunk func() error) error {
+	rows, err := d.Tx.FindChunk.Query(hash)
+	if err != nil {
+		return err
+	}
+
+	found := rows.Next()
+	rows.Close()
+	if found {
+		return nil
+	}
+
+	err = includeChunk()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Tx.InsertChunk.Exec(hash, d.E.Unix(), size)
+	d.Modified = true
 	return err
 }
 
+func (d *SeenDb) SetFileChunks(filename string, chunks []FileChunk) error {
+	for i := 0; i < len(chunks); i++ {
+		_, err := d.Tx.InsertFileChunk.Exec(filename, d.E.Unix(), i, chunks[i].Start, chunks[i].Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.Modified = true
+	return nil
+}
+
+func (d *SeenDb) ListLatestChunks(asOf *Edition, list func(string, *FileChunk) error) error {
+	rows, err := d.Tx.ListLatestChunks.Query(asOfUnix(asOf))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		filename := ""
+		var editionUnix int64
+		chunk := new(FileChunk)
+		err = rows.Scan(&filename, &chunk.Start, &chunk.Size, &chunk.Hash, &editionUnix)
+		if err != nil {
+			return err
+		}
+
+		chunk.E = EditionFromUnix(editionUnix)
+		err = list(filename, chunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *SeenDb) ListChunks(asOf *Edition, list func(string, *Edition) error) error {
+	rows, err := d.Tx.ListChunks.Query(asOfUnix(asOf))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		hash := ""
+		var editionUnix int64
+		err = rows.Scan(&hash, &editionUnix)
+		if err != nil {
+			return err
+		}
+
+		err = list(hash, EditionFromUnix(editionUnix))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *SeenDb) MergeEdition(from *Edition, into *Edition) (moved []string, refCopies []RefCopy, err error) {
+	// Gather up the entries first, so that we aren't
+	// changing rows whilst still reading them:
+	var current []string
+	links := make(map[string]string)
+	err = func() error {
+		rows, err := d.Tx.ListStillCurrent.Query(from.Unix(), from.Unix(), into.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var filename, hashStr, link string
+			err = rows.Scan(&filename, &hashStr, &link)
+			if err != nil {
+				return err
+			}
+
+			// Deletions have to move as well, otherwise an
+			// older copy of the file would reappear:
+			current = append(current, filename)
+			if hashStr != "" {
+				moved = append(moved, filename)
+			}
+
+			if link != "" {
+				links[filename] = link
+			}
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A hard link finds its contents in the latest version
+	// of its target, which in the new edition might not be
+	// the one it was linked to (if the target has changed or
+	// been deleted since).  Then it needs its own copy:
+	unlinked := make(map[string]*fileEdition)
+	for filename, link := range links {
+		var target *SeenEntry
+		target, err = d.GetLatest(link, into)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if target != nil && target.E.Unix() <= from.Unix() {
+			continue
+		}
+
+		var holder *fileEdition
+		holder, err = findContentHolder(d, link, from)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if holder != nil {
+			unlinked[filename] = holder
+		}
+	}
+
+	d.Modified = true
+	for i := 0; i < len(current); i++ {
+		_, err = d.Tx.MoveEntry.Exec(into.Unix(), current[i], from.Unix())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Anything sharing its contents will find them in
+		// the new edition:
+		_, err = d.Tx.MoveRefs.Exec(into.Unix(), current[i], from.Unix())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, err = d.Tx.MoveFileChunks.Exec(into.Unix(), current[i], from.Unix())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if holder, found := unlinked[current[i]]; found {
+			_, err = d.Tx.ClearLink.Exec(current[i], into.Unix())
+			if err != nil {
+				return nil, nil, err
+			}
+
+			refCopies = append(refCopies, RefCopy{holder.Filename, current[i], into, EditionFromUnix(holder.Edition)})
+		}
+	}
+
+	// The rest of the entries are going.  If anything else
+	// still shares their contents, the first file to do so
+	// gets a copy of them, and the others share that:
+	type ref struct {
+		Filename string
+		Edition  int64
+		Ref      string
+	}
+
+	var refs []ref
+	err = func() error {
+		rows, err := d.Tx.ListRefs.Query(from.Unix(), from.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var r ref
+			err = rows.Scan(&r.Filename, &r.Edition, &r.Ref)
+			if err != nil {
+				return err
+			}
+
+			refs = append(refs, r)
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copied := make(map[string]RefCopy)
+	for i := 0; i < len(refs); i++ {
+		if c, found := copied[refs[i].Ref]; found {
+			_, err = d.Tx.SetRef.Exec(c.Filename, c.E.Unix(), refs[i].Filename, refs[i].Edition)
+		} else {
+			c = RefCopy{refs[i].Ref, refs[i].Filename, EditionFromUnix(refs[i].Edition), from}
+			copied[refs[i].Ref] = c
+			refCopies = append(refCopies, c)
+			_, err = d.Tx.SetRef.Exec("", 0, refs[i].Filename, refs[i].Edition)
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	_, err = d.Tx.RemoveEdition.Exec(from.Unix())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = d.Tx.RemoveFileChunks.Exec(from.Unix())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The chunks that are still used move along with the
+	// files, and the rest go:
+	_, err = d.Tx.RemoveUnusedChunks.Exec(from.Unix())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = func() error {
+		rows, err := d.Tx.ListEditionChunks.Query(from.Unix())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			hash := ""
+			err = rows.Scan(&hash)
+			if err != nil {
+				return err
+			}
+
+			moved = append(moved, chunkEntryName(hash))
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = d.Tx.MoveChunks.Exec(into.Unix(), from.Unix())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = d.Tx.Tx.Exec(`delete from editions where edition=?`, from.Unix())
+	return moved, refCopies, err
+}
+
+// Commits everything so far, and writes a copy of the
+// database to the checkpoint file, recording how many
+// archive segments of my edition are complete, and the
+// last path the walk put in them.
+func (d *SeenDb) Checkpoint(checkpointFilename string, segments int, lastPath string) error {
+	_, err := d.Tx.Tx.Exec(`insert or replace into checkpoints (edition, segments, last_path) values (?, ?, ?)`, d.E.Unix(), segments, lastPath)
+	if err != nil {
+		return err
+	}
+
+	err = d.Tx.Close()
+	if err != nil {
+		return err
+	}
+
+	d.Tx, err = NewSeenTransaction(d.Db)
+	if err != nil {
+		return err
+	}
+
+	// (Resuming from the checkpoint will replace the
+	// database.)
+	err = d.keepOldVersion()
+	if err != nil {
+		return err
+	}
+
+	return d.writeOut(checkpointFilename)
+}
+
 func (d *SeenDb) Close() error {
 	// Always make sure we delete the temp file:
 	defer os.Remove(d.TempFile)
 
+	// A finished edition needs no checkpoint:
+	var cpErr error
+	if d.E != nil {
+		_, cpErr = d.Tx.Tx.Exec(`delete from checkpoints where edition=?`, d.E.Unix())
+	}
+
 	// Complete the transaction
 	txErr := d.Tx.Close()
 
 	// Close the database
 	dbErr := d.Db.Close()
 
-	// Re-encrypt the database file
-	f, err := os.Open(d.TempFile)
-	if err != nil {
-		return err
+	if dbErr != nil {
+		return dbErr
 	}
-	defer f.Close()
 
-	cipher, err := os.Create(d.Filename)
-	if err != nil {
-		return err
+	if txErr != nil {
+		return txErr
+	}
+
+	if cpErr != nil {
+		return cpErr
 	}
-	defer cipher.Close()
 
-	plain, err := d.Enc.WrapWriter(cipher)
+	// If we didn't change anything, leave the encrypted
+	// file alone (it might be on read-only media, if
+	// we're restoring):
+	if !d.Modified {
+		return nil
+	}
+
+	err := d.keepOldVersion()
 	if err != nil {
 		return err
 	}
-	defer plain.Close()
 
-	_, err = io.Copy(plain, f)
+	return d.writeOut(d.Filename)
+}
+
+// Keeps a copy of the database file if it has an older
+// schema, since we're about to replace it with one that
+// older versions of the program can't read.
+func (d *SeenDb) keepOldVersion() error {
+	if d.Version >= schemaVersion() {
+		return nil
+	}
+
+	err := keepOldVersion(d.Filename, d.Version)
+	if err == nil {
+		d.Version = schemaVersion()
+	}
+
+	return err
+}
+
+// Re-encrypts the database file, replacing the old one
+// only once the new one is safely written.
+func (d *SeenDb) writeOut(filename string) error {
+	f, err := os.Open(d.TempFile)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
+	return writeAtomically(filename, func(cipher *os.File) error {
+		plain, err := d.Enc.WrapWriter(cipher)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(plain, f)
+		if err == nil {
+			err = plain.Close()
+		}
+
+		return err
+	})
+}
+
+func (d *SeenDb) Abort() error {
+	defer os.Remove(d.TempFile)
+
+	txErr := d.Tx.Abort()
+	dbErr := d.Db.Close()
 	if dbErr != nil {
 		return dbErr
 	}
@@ -223,17 +990,11 @@ func NewSeenDb(filename string, encrypt Encrypt, edition *Edition) (seenDb *Seen
 		return nil, err
 	}
 
-	// Create table if not already there, ignoring result
-	// TODO Store mtime nanos as well ?
-	_, err = db.Exec(
-		`create table files(
-        filename text,
-        edition integer,
-        mtime integer,
-        hash text,
-        primary key (filename, edition))`)
+	// Bring it up to date:
+	version, err := migrateDb(db)
 	if err != nil {
-		fmt.Printf("%s\n", err.Error())
+		db.Close()
+		return nil, err
 	}
 
 	// Open my starting transaction
@@ -243,5 +1004,50 @@ func NewSeenDb(filename string, encrypt Encrypt, edition *Edition) (seenDb *Seen
 		return nil, err
 	}
 
-	return &SeenDb{db, edition, tx, encrypt, tempFile, filename}, nil
+	// (If we upgraded it, it's only written back if the
+	// caller keeps the upgrade.)
+	return &SeenDb{db, edition, tx, make(map[string]struct{}), false, encrypt, tempFile, filename, Detect_Mtime, 0, version}, nil
+}
+
+// Makes sure that a database we upgraded on opening gets
+// written back, even if nothing else changes, so that we
+// only upgrade it the once.  Commands that only read the
+// database leave it as it was.
+func (d *SeenDb) KeepUpgrade() {
+	if d.Version < schemaVersion() {
+		d.Modified = true
+	}
+}
+
+// Closes a database we've only read from, keeping the
+// first error.
+func closeReadOnly(d *SeenDb, err *error) {
+	closeErr := d.Close()
+	if *err == nil {
+		*err = closeErr
+	}
+}
+
+// Opens the database as it was at the last checkpoint,
+// returning the number of archive segments that were
+// complete then, and the last path in them (blank if the
+// checkpoint is from before we recorded it).  It will be
+// written back to `filename' when closed.
+func NewSeenDbFromCheckpoint(checkpointFilename string, filename string, encrypt Encrypt) (seenDb *SeenDb, segments int, lastPath string, err error) {
+	seenDb, err = NewSeenDb(checkpointFilename, encrypt, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var editionUnix int64
+	err = seenDb.Tx.Tx.QueryRow(`select edition, segments, last_path from checkpoints`).Scan(&editionUnix, &segments, &lastPath)
+	if err != nil {
+		seenDb.Abort()
+		return nil, 0, "", err
+	}
+
+	seenDb.E = EditionFromUnix(editionUnix)
+	seenDb.Filename = filename
+	seenDb.Modified = true
+	return seenDb, segments, lastPath, nil
 }
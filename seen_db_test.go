@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A file whose metadata change, but not its contents, gets
+// a new entry with them, leaving the earlier editions'
+// entries as they were.
+func TestMetadataChanged(t *testing.T) {
+	tests := []string{Detect_Mtime, Detect_Metadata, Detect_Always}
+	for i := 0; i < len(tests); i++ {
+		j := newTestJob(t, Job{ChangeDetection: tests[i]})
+		defer j.Close()
+
+		mtimes := []time.Time{
+			time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			// (Going back in time counts too.)
+			time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+
+		var editions []*Edition
+		j.Write("a", "contents of a")
+		for k := 0; k < len(mtimes); k++ {
+			j.Touch("a", mtimes[k])
+			editions = append(editions, j.Backup())
+		}
+
+		for k := 0; k < len(mtimes); k++ {
+			info, err := os.Stat(filepath.Join(j.RestoreDir(editions[k]), "a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !info.ModTime().Equal(mtimes[k]) {
+				t.Errorf("%s : Restored %s with mtime %s, expected %s", tests[i], editions[k].String(), info.ModTime(), mtimes[k])
+			}
+		}
+
+		// Now that it's up to date, we don't read it again
+		// (unless we always do):
+		j.Backup()
+		list := j.ListEditionStats()
+		if read := list[len(list)-1].BytesRead; (read != 0) != (tests[i] == Detect_Always) {
+			t.Errorf("%s : Read %d bytes", tests[i], read)
+		}
+	}
+}
+
+// Copies and renames share the contents already backed up,
+// which are kept when the edition they were in is pruned.
+func TestSharedContents(t *testing.T) {
+	j := newTestJob(t, Job{})
+	defer j.Close()
+
+	contents := string(randomData(6, MemberMinSize))
+	j.Write("a", contents)
+	j.Write("b", contents)
+	j.Backup()
+
+	j.Write("copy", contents)
+	err := os.Rename(j.Src("b"), j.Src("renamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := j.Backup()
+	if size := j.ArchiveSize(e); size >= MemberMinSize {
+		t.Errorf("Archive has %d bytes", size)
+	}
+
+	j.Remove("a")
+	j.Backup()
+	j.Prune(Retention{Daily: 1})
+	checkTree(t, "After pruning", j.Restore(nil), map[string]string{
+		"copy":    contents,
+		"renamed": contents,
+	})
+}
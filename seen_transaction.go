@@ -8,38 +8,112 @@ import (
 
 type SeenTransaction struct {
 	Tx                  *sql.Tx
-	GetLatestMtimeHash  *sql.Stmt
+	GetLatest           *sql.Stmt
+	GetEntry            *sql.Stmt
+	ListEntries         *sql.Stmt
+	ListLatest          *sql.Stmt
 	InsertNewEdition    *sql.Stmt
-	ListEditions        *sql.Stmt
+	ListNeededEditions  *sql.Stmt
 	RemoveEditionsAfter *sql.Stmt
+	ListStillCurrent    *sql.Stmt
+	MoveEntry           *sql.Stmt
+	ClearLink           *sql.Stmt
+	RemoveEdition       *sql.Stmt
+	FindContent         *sql.Stmt
+	MoveRefs            *sql.Stmt
+	ListRefs            *sql.Stmt
+	SetRef              *sql.Stmt
+	FindChunk           *sql.Stmt
+	InsertChunk         *sql.Stmt
+	InsertFileChunk     *sql.Stmt
+	ListLatestChunks    *sql.Stmt
+	ListChunks          *sql.Stmt
+	MoveFileChunks      *sql.Stmt
+	RemoveFileChunks    *sql.Stmt
+	RemoveUnusedChunks  *sql.Stmt
+	ListEditionChunks   *sql.Stmt
+	MoveChunks          *sql.Stmt
+	RecordEdition       *sql.Stmt
+	ListEditionStats    *sql.Stmt
 }
 
 func (tx *SeenTransaction) Close() error {
 	return tx.Tx.Commit()
 }
 
+func (tx *SeenTransaction) Abort() error {
+	return tx.Tx.Rollback()
+}
+
 func NewSeenTransaction(db *sql.DB) (*SeenTransaction, error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
 
-	getLatestMtimeHash, err := tx.Prepare(
-		`select mtime, hash from files
-        where filename=?
-        order by mtime desc`)
+	getLatest, err := tx.Prepare(
+		`select edition, mtime, mtime_nsec, size, ctime, inode, hash, link, ref, ref_edition, rebuilt from files
+        where filename=? and edition<=?
+        order by edition desc
+        limit 1`)
+	if err != nil {
+		return nil, err
+	}
+
+	getEntry, err := tx.Prepare(
+		`select edition, mtime, mtime_nsec, size, ctime, inode, hash, link, ref, ref_edition, rebuilt from files
+        where filename=? and edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	listEntries, err := tx.Prepare(
+		`select filename, edition, mtime, mtime_nsec, size, ctime, inode, hash, link, ref, ref_edition, rebuilt from files
+        where edition<=?
+        order by edition, filename`)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite takes the bare columns from the row that
+	// provided the max():
+	listLatest, err := tx.Prepare(
+		`select filename, max(edition), mtime, mtime_nsec, size, ctime, inode, hash, link, ref, ref_edition, rebuilt from files
+        where edition<=?
+        group by filename`)
 	if err != nil {
 		return nil, err
 	}
 
 	insertNewEdition, err := tx.Prepare(
-		`insert into files values (?, ?, ?, ?)`)
+		`insert into files (filename, edition, mtime, mtime_nsec, size, ctime, inode, hash, link, ref, ref_edition, unstable, rebuilt)
+        values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return nil, err
 	}
 
-	listEditions, err := tx.Prepare(
-		`select edition from files`)
+	// (A reference needs the edition holding the contents,
+	// as well as its own.)
+	listNeededEditions, err := tx.Prepare(
+		`select distinct edition from (
+            select hash, max(edition) as edition from files
+            where edition<=?
+            group by filename)
+        where hash!=''
+        union
+        select distinct ref_edition from (
+            select hash, ref, ref_edition, max(edition) from files
+            where edition<=?
+            group by filename)
+        where hash!='' and ref!=''
+        union
+        select distinct k.edition from file_chunks c
+        join (
+            select filename, max(edition) as edition from files
+            where edition<=?
+            group by filename) l
+        on c.filename=l.filename and c.edition=l.edition
+        join chunks k on k.hash=c.hash`)
 	if err != nil {
 		return nil, err
 	}
@@ -50,5 +124,157 @@ func NewSeenTransaction(db *sql.DB) (*SeenTransaction, error) {
 		return nil, err
 	}
 
-	return &SeenTransaction{tx, getLatestMtimeHash, insertNewEdition, listEditions, removeEditionsAfter}, nil
+	// (edition, edition, later edition)
+	listStillCurrent, err := tx.Prepare(
+		`select filename, hash, link from files f
+        where edition=? and not exists (
+            select 1 from files g
+            where g.filename=f.filename and g.edition>? and g.edition<=?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (new edition, filename, old edition)
+	moveEntry, err := tx.Prepare(
+		`update files set edition=? where filename=? and edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (filename, edition)
+	clearLink, err := tx.Prepare(
+		`update files set link='' where filename=? and edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	removeEdition, err := tx.Prepare(
+		`delete from files where edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finds an entry whose contents are in an archive:
+	findContent, err := tx.Prepare(
+		`select filename, edition from files f
+        where hash=? and link='' and ref='' and not exists (
+            select 1 from file_chunks c
+            where c.filename=f.filename and c.edition=f.edition)
+        order by edition
+        limit 1`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (new edition, filename, old edition)
+	moveRefs, err := tx.Prepare(
+		`update files set ref_edition=? where ref=? and ref_edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (edition referred to, edition not to list)
+	listRefs, err := tx.Prepare(
+		`select filename, edition, ref from files
+        where ref_edition=? and edition!=?
+        order by edition, filename`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (ref, ref edition, filename, edition)
+	setRef, err := tx.Prepare(
+		`update files set ref=?, ref_edition=? where filename=? and edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	findChunk, err := tx.Prepare(
+		`select edition from chunks where hash=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (hash, edition, size)
+	insertChunk, err := tx.Prepare(
+		`insert into chunks values (?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (filename, edition, seq, start, hash)
+	insertFileChunk, err := tx.Prepare(
+		`insert into file_chunks values (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	listLatestChunks, err := tx.Prepare(
+		`select c.filename, c.start, k.size, c.hash, k.edition from file_chunks c
+        join (
+            select filename, max(edition) as edition from files
+            where edition<=?
+            group by filename) l
+        on c.filename=l.filename and c.edition=l.edition
+        join chunks k on k.hash=c.hash
+        order by c.filename, c.seq`)
+	if err != nil {
+		return nil, err
+	}
+
+	listChunks, err := tx.Prepare(
+		`select hash, edition from chunks where edition<=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (new edition, filename, old edition)
+	moveFileChunks, err := tx.Prepare(
+		`update file_chunks set edition=? where filename=? and edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	removeFileChunks, err := tx.Prepare(
+		`delete from file_chunks where edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	removeUnusedChunks, err := tx.Prepare(
+		`delete from chunks
+        where edition=? and not exists (
+            select 1 from file_chunks c where c.hash=chunks.hash)`)
+	if err != nil {
+		return nil, err
+	}
+
+	listEditionChunks, err := tx.Prepare(
+		`select hash from chunks where edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	// (new edition, old edition)
+	moveChunks, err := tx.Prepare(
+		`update chunks set edition=? where edition=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	recordEdition, err := tx.Prepare(
+		`insert or replace into editions (edition, start_time, end_time, hostname, job, prefix, scanned, added, failed, unstable, bytes_read, bytes_stored)
+        values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+
+	listEditionStats, err := tx.Prepare(
+		`select edition, start_time, end_time, hostname, job, prefix, scanned, added, failed, unstable, bytes_read, bytes_stored from editions
+        order by edition`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SeenTransaction{tx, getLatest, getEntry, listEntries, listLatest, insertNewEdition, listNeededEditions, removeEditionsAfter, listStillCurrent, moveEntry, clearLink, removeEdition, findContent, moveRefs, listRefs, setRef, findChunk, insertChunk, insertFileChunk, listLatestChunks, listChunks, moveFileChunks, removeFileChunks, removeUnusedChunks, listEditionChunks, moveChunks, recordEdition, listEditionStats}, nil
 }
@@ -0,0 +1,251 @@
+/* Sparse files.  archive/tar reads the GNU sparse format
+ * (in PAX headers), but won't write it, so we write those
+ * entries ourselves.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+	blockSize       = 512
+	sparseBlockSize = 4096
+)
+
+// A region of a sparse file that holds data.
+type SparseEntry struct {
+	Offset int64
+	Length int64
+}
+
+// Tells whether an entry read from an archive was stored
+// as a sparse file.
+func isSparseHeader(hdr *tar.Header) bool {
+	_, found := hdr.PAXRecords["GNU.sparse.major"]
+	return found
+}
+
+// Writes a whole sparse file entry, in the PAX 1.0 sparse
+// format, containing just the data regions of the file.
+// The whole of the file, holes and all, goes to `h'.
+func writeSparseFile(archive *ArchiveWriter, hdr *tar.Header, filename string, data []SparseEntry, h io.Writer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The sparse map comes first, padded out to a block:
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(data))
+	storedSize := int64(0)
+	for i := 0; i < len(data); i++ {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", data[i].Offset, data[i].Length)
+		storedSize += data[i].Length
+	}
+
+	sparseMap.Write(make([]byte, blockPadding(int64(sparseMap.Len()))))
+	storedSize += int64(sparseMap.Len())
+
+	// We write our own headers underneath the tar writer,
+	// so make sure it's finished with the last entry:
+	err = archive.Tar.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = archive.Compressed.Write(formatSparseHeaders(hdr, storedSize))
+	if err == nil {
+		_, err = sparseMap.WriteTo(archive.Compressed)
+	}
+
+	hashed := int64(0)
+	for i := 0; i < len(data) && err == nil; i++ {
+		_, err = io.CopyN(h, zeroReader{}, data[i].Offset-hashed)
+		if err == nil {
+			err = copyExactly(io.MultiWriter(archive.Compressed, h), io.NewSectionReader(f, data[i].Offset, data[i].Length), data[i].Length)
+			hashed = data[i].Offset + data[i].Length
+		}
+	}
+
+	if err == nil {
+		_, err = io.CopyN(h, zeroReader{}, hdr.Size-hashed)
+	}
+
+	if err == nil {
+		_, err = archive.Compressed.Write(make([]byte, blockPadding(storedSize)))
+	}
+
+	return err
+}
+
+// Reads as many zeroes as you like.
+type zeroReader struct {
+}
+
+func (z zeroReader) Read(data []byte) (int, error) {
+	for i := 0; i < len(data); i++ {
+		data[i] = 0
+	}
+
+	return len(data), nil
+}
+
+// Makes the PAX extended header and the ustar header of a
+// sparse file entry.  Everything that matters goes in the
+// PAX records; the ustar header is only a fallback.
+func formatSparseHeaders(hdr *tar.Header, storedSize int64) []byte {
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+		"size":                strconv.FormatInt(storedSize, 10),
+		"mtime":               fmt.Sprintf("%d.%09d", hdr.ModTime.Unix(), hdr.ModTime.Nanosecond()),
+		"uid":                 strconv.Itoa(hdr.Uid),
+		"gid":                 strconv.Itoa(hdr.Gid),
+	}
+
+	if hdr.Uname != "" {
+		records["uname"] = hdr.Uname
+	}
+
+	if hdr.Gname != "" {
+		records["gname"] = hdr.Gname
+	}
+
+	for key, value := range hdr.PAXRecords {
+		records[key] = value
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var pax bytes.Buffer
+	for i := 0; i < len(keys); i++ {
+		pax.WriteString(formatPAXRecord(keys[i], records[keys[i]]))
+	}
+
+	dir, file := path.Split(hdr.Name)
+	var headers bytes.Buffer
+	headers.Write(formatUstarHeader(path.Join(dir, "PaxHeaders.0", file), tar.TypeXHeader, int64(pax.Len()), hdr))
+	pax.WriteTo(&headers)
+	headers.Write(make([]byte, blockPadding(int64(headers.Len()))))
+	headers.Write(formatUstarHeader(path.Join(dir, "GNUSparseFile.0", file), tar.TypeReg, storedSize, hdr))
+	return headers.Bytes()
+}
+
+// Formats a "<length> <key>=<value>\n" record, where the
+// length includes itself.
+func formatPAXRecord(key string, value string) string {
+	size := len(key) + len(value) + 3
+	size += len(strconv.Itoa(size))
+	record := fmt.Sprintf("%d %s=%s\n", size, key, value)
+
+	// Adding the length might have made it a digit longer:
+	if len(record) != size {
+		record = fmt.Sprintf("%d %s=%s\n", len(record), key, value)
+	}
+
+	return record
+}
+
+func formatUstarHeader(name string, typeflag byte, size int64, hdr *tar.Header) []byte {
+	block := make([]byte, blockSize)
+	copy(block[0:100], name)
+	formatOctal(block[100:108], hdr.Mode&07777)
+	formatOctal(block[108:116], int64(hdr.Uid))
+	formatOctal(block[116:124], int64(hdr.Gid))
+	formatOctal(block[124:136], size)
+	formatOctal(block[136:148], hdr.ModTime.Unix())
+	block[156] = typeflag
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	copy(block[265:297], hdr.Uname)
+	copy(block[297:329], hdr.Gname)
+
+	// The checksum is worked out with its own field as
+	// spaces:
+	copy(block[148:156], "        ")
+	sum := int64(0)
+	for i := 0; i < len(block); i++ {
+		sum += int64(block[i])
+	}
+
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+// Fills in a NUL-terminated octal field, or leaves it at
+// zero if the value doesn't fit (the PAX records have it).
+func formatOctal(field []byte, value int64) {
+	digits := fmt.Sprintf("%0*o", len(field)-1, value)
+	if value >= 0 && len(digits) == len(field)-1 {
+		copy(field, digits)
+	}
+}
+
+func blockPadding(size int64) int64 {
+	return -size & (blockSize - 1)
+}
+
+// Writes a file, seeking over blocks of zeros rather than
+// writing them, so that they become holes.
+type sparseWriter struct {
+	F      *os.File
+	Offset int64
+}
+
+func (w *sparseWriter) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		// Work in whole blocks of the file:
+		length := sparseBlockSize - int(w.Offset%sparseBlockSize)
+		if length > len(p)-n {
+			length = len(p) - n
+		}
+
+		chunk := p[n : n+length]
+		if isZero(chunk) {
+			_, err = w.F.Seek(int64(length), io.SeekCurrent)
+		} else {
+			_, err = w.F.Write(chunk)
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		n += length
+		w.Offset += int64(length)
+	}
+
+	return n, nil
+}
+
+// Sets the file's size, in case it ends with a hole.
+func (w *sparseWriter) Finish() error {
+	return w.F.Truncate(w.Offset)
+}
+
+func isZero(p []byte) bool {
+	for i := 0; i < len(p); i++ {
+		if p[i] != 0 {
+			return false
+		}
+	}
+
+	return true
+}
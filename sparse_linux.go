@@ -0,0 +1,68 @@
+/* Linux specific package for finding the holes in sparse
+ * files in backup.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Gets the regions of the file that hold data, or nil if
+// it isn't sparse.
+func GetSparseData(filename string, info os.FileInfo) ([]SparseEntry, error) {
+	// If all the blocks are allocated, it can't have holes:
+	sys, found := info.Sys().(*syscall.Stat_t)
+	if !found || sys.Blocks*512 >= info.Size() {
+		return nil, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var data []SparseEntry
+	size := info.Size()
+	offset := int64(0)
+	for offset < size {
+		start, err := f.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// There's nothing but a hole from here on.
+			break
+		} else if errors.Is(err, syscall.EINVAL) {
+			// The filesystem can't tell us.
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+
+		if end > size {
+			end = size
+		}
+
+		data = append(data, SparseEntry{start, end - start})
+		offset = end
+	}
+
+	// The size of the file comes from the last entry, so
+	// if it ends in a hole, mark the end:
+	if len(data) == 0 || offset < size {
+		data = append(data, SparseEntry{size, 0})
+	}
+
+	return data, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatPAXRecord(t *testing.T) {
+	tests := []struct {
+		Key    string
+		Value  string
+		Record string
+	}{
+		{"path", "a", "9 path=a\n"},
+		{"uid", "", "7 uid=\n"},
+		// Just short of, and just over, a third digit:
+		{"k", strings.Repeat("v", 93), "99 k=" + strings.Repeat("v", 93) + "\n"},
+		{"k", strings.Repeat("v", 94), "101 k=" + strings.Repeat("v", 94) + "\n"},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		record := formatPAXRecord(tests[i].Key, tests[i].Value)
+		if record != tests[i].Record {
+			t.Errorf("%s : Formatted %q, expected %q", tests[i].Key, record, tests[i].Record)
+		}
+
+		size, err := strconv.Atoi(record[:strings.IndexByte(record, ' ')])
+		if err != nil || size != len(record) {
+			t.Errorf("%s : Record of %d bytes says %d", tests[i].Key, len(record), size)
+		}
+	}
+}
+
+func TestFormatSparseHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		Name    string
+		Size    int64
+		Data    []SparseEntry
+		Records map[string]string
+	}{
+		{"d/holey", 3*sparseBlockSize + 100, []SparseEntry{{0, 5}, {2 * sparseBlockSize, 3}}, nil},
+		{strings.Repeat("long/", 30) + "holey", 2 * sparseBlockSize, []SparseEntry{{sparseBlockSize, 10}}, map[string]string{"SCHILY.xattr.user.x": "y"}},
+		{"empty", sparseBlockSize, nil, nil},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		contents := make([]byte, tests[i].Size)
+		for j := 0; j < len(tests[i].Data); j++ {
+			for k := int64(0); k < tests[i].Data[j].Length; k++ {
+				contents[tests[i].Data[j].Offset+k] = byte('a' + k)
+			}
+		}
+
+		filename := filepath.Join(dir, strconv.Itoa(i))
+		err = ioutil.WriteFile(filename, contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := &tar.Header{
+			Name:       tests[i].Name,
+			Size:       tests[i].Size,
+			Mode:       0644,
+			Uid:        1000,
+			Uname:      "someone",
+			ModTime:    time.Unix(1600000000, 123456789),
+			PAXRecords: tests[i].Records,
+		}
+
+		h := sha256.New()
+		entries, err := bufferEntries(func(w *ArchiveWriter) error {
+			return writeSparseFile(w, hdr, filename, tests[i].Data, h)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hash := sha256.Sum256(contents); !bytes.Equal(h.Sum(nil), hash[:]) {
+			t.Errorf("%s : Hashed the wrong contents", tests[i].Name)
+		}
+
+		// (The end of the archive.)
+		entries.Write(make([]byte, 2*blockSize))
+
+		reader := tar.NewReader(entries)
+		read, err := reader.Next()
+		if err != nil {
+			t.Fatalf("%s : %s", tests[i].Name, err.Error())
+		}
+
+		if read.Name != hdr.Name || read.Size != hdr.Size || !read.ModTime.Equal(hdr.ModTime) || read.Uid != hdr.Uid || read.Uname != hdr.Uname || !isSparseHeader(read) {
+			t.Errorf("%s : Read back header %+v", tests[i].Name, read)
+		}
+
+		for key, value := range tests[i].Records {
+			if read.PAXRecords[key] != value {
+				t.Errorf("%s : Lost record %s", tests[i].Name, key)
+			}
+		}
+
+		readContents, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%s : %s", tests[i].Name, err.Error())
+		}
+
+		if !bytes.Equal(readContents, contents) {
+			t.Errorf("%s : Read back the wrong contents", tests[i].Name)
+		}
+
+		_, err = reader.Next()
+		if err != io.EOF {
+			t.Errorf("%s : Expected the end of the archive, found %v", tests[i].Name, err)
+		}
+	}
+}
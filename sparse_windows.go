@@ -0,0 +1,14 @@
+/* Windows specific package for finding the holes in sparse
+ * files in backup.
+ */
+
+package main
+
+import (
+	"os"
+)
+
+func GetSparseData(filename string, info os.FileInfo) ([]SparseEntry, error) {
+	// We don't look for holes on Windows.
+	return nil, nil
+}
@@ -0,0 +1,41 @@
+/* Linux specific package for restoring device nodes and
+ * FIFOs in backup.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"syscall"
+)
+
+func RestoreSpecial(path string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	default:
+		return errors.New("Unknown special file type")
+	}
+
+	// We might be restoring over an older one:
+	os.Remove(path)
+
+	err := syscall.Mknod(path, mode, int(makeDev(hdr.Devmajor, hdr.Devminor)))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// Encodes a device number the way glibc's makedev does.
+func makeDev(major int64, minor int64) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
@@ -0,0 +1,14 @@
+/* Windows specific package for restoring device nodes and
+ * FIFOs in backup.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+)
+
+func RestoreSpecial(path string, hdr *tar.Header) error {
+	return errors.New("Device files and pipes can't be restored on Windows")
+}
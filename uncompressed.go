@@ -0,0 +1,123 @@
+/* Recognises files that are compressed already, such as
+ * photos, videos and zip files, so that we can store them
+ * without trying to compress them again.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Some bytes that a format has at a given offset.
+type magicNumber struct {
+	Offset int
+	Bytes  []byte
+}
+
+// The formats we can recognise, by name.  A file is in a
+// format if it has all of its magic numbers.
+var knownFormats = map[string][]magicNumber{
+	"jpeg":     {{0, []byte{0xff, 0xd8, 0xff}}},
+	"png":      {{0, []byte{0x89, 'P', 'N', 'G'}}},
+	"gif":      {{0, []byte("GIF8")}},
+	"webp":     {{0, []byte("RIFF")}, {8, []byte("WEBP")}},
+	"mp4":      {{4, []byte("ftyp")}},
+	"matroska": {{0, []byte{0x1a, 0x45, 0xdf, 0xa3}}},
+	"ogg":      {{0, []byte("OggS")}},
+	"flac":     {{0, []byte("fLaC")}},
+	"mp3":      {{0, []byte("ID3")}},
+	"zip":      {{0, []byte{'P', 'K', 3, 4}}},
+	"gzip":     {{0, gzipMagic}},
+	"bzip2":    {{0, []byte("BZh")}},
+	"xz":       {{0, xzMagic}},
+	"zstd":     {{0, zstdMagic}},
+	"7z":       {{0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}}},
+	"rar":      {{0, []byte("Rar!")}},
+}
+
+// Enough of a file to see all the magic numbers.
+const magicLength = 12
+
+// Decides which files to store without compression.
+type StoreFilter struct {
+	Extensions map[string]struct{}
+	Formats    [][]magicNumber
+}
+
+// `uncompressed' lists file extensions (like ".jpg") and
+// format names (like "jpeg") to store without compression.
+// If it's nil, we look for all the formats we know.
+func NewStoreFilter(uncompressed []string) (*StoreFilter, error) {
+	s := &StoreFilter{make(map[string]struct{}), nil}
+	if uncompressed == nil {
+		for _, format := range knownFormats {
+			s.Formats = append(s.Formats, format)
+		}
+
+		return s, nil
+	}
+
+	for i := 0; i < len(uncompressed); i++ {
+		if strings.HasPrefix(uncompressed[i], ".") {
+			s.Extensions[strings.ToLower(uncompressed[i])] = struct{}{}
+			continue
+		}
+
+		format, found := knownFormats[strings.ToLower(uncompressed[i])]
+		if !found {
+			return nil, errors.New(fmt.Sprintf("Unknown format %s", uncompressed[i]))
+		}
+
+		s.Formats = append(s.Formats, format)
+	}
+
+	return s, nil
+}
+
+// Tells whether a file looks to be compressed already.
+func (s *StoreFilter) Store(filename string) bool {
+	if _, found := s.Extensions[strings.ToLower(filepath.Ext(filename))]; found {
+		return true
+	}
+
+	if len(s.Formats) == 0 {
+		return false
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		// (We'll find out properly when we archive it.)
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, magicLength)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+
+	for i := 0; i < len(s.Formats); i++ {
+		if hasMagic(magic, s.Formats[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasMagic(magic []byte, format []magicNumber) bool {
+	for i := 0; i < len(format); i++ {
+		end := format[i].Offset + len(format[i].Bytes)
+		if end > len(magic) || !bytes.Equal(magic[format[i].Offset:end], format[i].Bytes) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"photo.dat":   {0xff, 0xd8, 0xff, 0xe0, 0, 0x10, 'J', 'F', 'I', 'F'},
+		"image.webp":  []byte("RIFF\x00\x00\x00\x00WEBPVP8 "),
+		"fake.webp":   []byte("RIFF\x00\x00\x00\x00WAVEfmt "),
+		"movie":       []byte("\x00\x00\x00\x18ftypmp42"),
+		"tiny":        {0xff, 0xd8},
+		"empty":       {},
+		"notes.txt":   []byte("some text that compresses"),
+		"Archive.ZIP": []byte("not really a zip"),
+	}
+
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Uncompressed []string
+		Stored       map[string]bool
+	}{
+		// Every format we know, by default:
+		{nil, map[string]bool{
+			"photo.dat": true, "image.webp": true, "fake.webp": false, "movie": true,
+			"tiny": false, "empty": false, "notes.txt": false, "Archive.ZIP": false, "missing": false,
+		}},
+		// Nothing at all:
+		{[]string{}, map[string]bool{
+			"photo.dat": false, "image.webp": false, "movie": false, "notes.txt": false,
+		}},
+		// Just these, whatever their case:
+		{[]string{".zip", "JPEG"}, map[string]bool{
+			"photo.dat": true, "image.webp": false, "movie": false, "Archive.ZIP": true, "notes.txt": false,
+		}},
+		{[]string{".TXT"}, map[string]bool{
+			"notes.txt": true, "photo.dat": false, "missing.txt": true,
+		}},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		s, err := NewStoreFilter(tests[i].Uncompressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, stored := range tests[i].Stored {
+			if s.Store(filepath.Join(dir, name)) != stored {
+				t.Errorf("%v : Expected %s stored %v", tests[i].Uncompressed, name, stored)
+			}
+		}
+	}
+
+	_, err = NewStoreFilter([]string{"jpeg", "bmp"})
+	if err == nil {
+		t.Errorf("Accepted an unknown format")
+	}
+}
@@ -14,8 +14,6 @@ func AssignUserIds(info os.FileInfo, hdr *tar.Header) {
 	if sys, found := info.Sys().(*syscall.Stat_t); found {
 		hdr.Uid = int(sys.Uid)
 		hdr.Gid = int(sys.Gid)
-
-		// TODO Extended attributes
 	}
 }
 
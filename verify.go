@@ -0,0 +1,199 @@
+/* Checks the archives against the seen database. */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Identifies one entry in the seen database.
+type fileEdition struct {
+	Filename string
+	Edition  int64
+}
+
+// Reads every archive up to the given edition (or all of
+// them, if nil), listing their contents and checking that
+// each file matches the hash in the database.
+func (r *RunningJob) DoVerify(filter Filter, prefix string, repl Replacement, encrypt Encrypt, asOf *Edition) (err error) {
+	// Open up the database:
+	fmt.Printf("Opening database %s\n", r.GetDbFilename())
+	seenDb, err := NewSeenDb(r.GetDbFilename(), encrypt, r.E)
+	if err != nil {
+		return err
+	}
+	defer closeReadOnly(seenDb, &err)
+
+	archives, err := r.GetOldEditionFilenames()
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(archives)
+
+	problems := 0
+	report := func(path string, problem string) {
+		fmt.Printf("%s : %s\n", path, problem)
+		problems += 1
+	}
+
+	found := make(map[fileEdition]struct{})
+	foundChunks := make(map[fileEdition]struct{})
+	for i := 0; i < archives.Len(); i++ {
+		edition := archives.Names[i].E
+		if asOf != nil && edition.Unix() > asOf.Unix() {
+			continue
+		}
+
+		fmt.Printf("Testing %s...\n", archives.GetName(i))
+		readErr := readArchive(archives.GetName(i), encrypt, func(hdr *tar.Header, reader io.Reader) error {
+			// A chunk is named after its hash:
+			if isChunkEntry(hdr) {
+				h := sha256.New()
+				_, err := io.Copy(h, reader)
+				if err != nil {
+					return err
+				}
+
+				hash := strings.TrimPrefix(hdr.Name, ChunkPrefix)
+				foundChunks[fileEdition{hash, edition.Unix()}] = struct{}{}
+				if hex.EncodeToString(h.Sum(nil)) != hash {
+					report(hdr.Name, "Hash mismatch")
+				}
+
+				return nil
+			}
+
+			if !filter.Include(hdr.Name) {
+				return nil
+			}
+
+			fmt.Printf("%s\n", filepath.Join(prefix, repl.Replace(hdr.Name)))
+			if (hdr.FileInfo().Mode() & os.ModeType) != 0 {
+				return nil
+			}
+
+			// A reference has no contents of its own, but
+			// the file it refers to should.  A file stored
+			// in chunks has none either:
+			if isRefHeader(hdr) || isChunkedHeader(hdr) {
+				entry, err := seenDb.GetEntry(hdr.Name, edition)
+				if err != nil {
+					return err
+				}
+
+				if entry == nil || entry.IsDeleted() {
+					report(hdr.Name, "Not in database")
+					return nil
+				}
+
+				found[fileEdition{hdr.Name, edition.Unix()}] = struct{}{}
+				if entry.Ref == "" {
+					return nil
+				}
+
+				target, err := seenDb.GetEntry(entry.Ref, entry.RefE)
+				if err != nil {
+					return err
+				}
+
+				if target == nil || !bytes.Equal(target.Hash, entry.Hash) {
+					report(hdr.Name, fmt.Sprintf("Missing contents of %s in edition %s", entry.Ref, entry.RefE.String()))
+				}
+
+				return nil
+			}
+
+			// A hard link has no contents of its own:
+			if hdr.Typeflag == tar.TypeLink {
+				entry, err := seenDb.GetEntry(hdr.Name, edition)
+				if err != nil {
+					return err
+				}
+
+				if entry == nil || entry.IsDeleted() {
+					report(hdr.Name, "Not in database")
+				} else {
+					found[fileEdition{hdr.Name, edition.Unix()}] = struct{}{}
+					if entry.Link != hdr.Linkname {
+						report(hdr.Name, "Link mismatch")
+					}
+				}
+
+				return nil
+			}
+
+			h := sha256.New()
+			_, err := io.Copy(h, reader)
+			if err != nil {
+				return err
+			}
+
+			entry, err := seenDb.GetEntry(hdr.Name, edition)
+			if err != nil {
+				return err
+			}
+
+			if entry == nil || entry.IsDeleted() {
+				report(hdr.Name, "Not in database")
+			} else {
+				found[fileEdition{hdr.Name, edition.Unix()}] = struct{}{}
+				if !bytes.Equal(h.Sum(nil), entry.Hash) {
+					report(hdr.Name, "Hash mismatch")
+				}
+			}
+
+			return nil
+		})
+
+		if readErr != nil {
+			report(archives.GetName(i), readErr.Error())
+		}
+	}
+
+	// Everything in the database should have turned up:
+	err = seenDb.ListEntries(asOf, func(filename string, entry *SeenEntry) error {
+		if entry.IsDeleted() || !filter.Include(filename) {
+			return nil
+		}
+
+		if _, ok := found[fileEdition{filename, entry.E.Unix()}]; !ok {
+			report(filename, fmt.Sprintf("Missing from edition %s", entry.E.String()))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = seenDb.ListChunks(asOf, func(hash string, edition *Edition) error {
+		if _, ok := foundChunks[fileEdition{hash, edition.Unix()}]; !ok {
+			report(chunkEntryName(hash), fmt.Sprintf("Missing from edition %s", edition.String()))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if problems > 0 {
+		return errors.New(fmt.Sprintf("%s : Found %d problems", r.J.BaseName, problems))
+	}
+
+	fmt.Printf("%s : No problems found\n", r.J.BaseName)
+	return nil
+}
@@ -0,0 +1,140 @@
+/* Linux specific package for handling extended attributes
+ * in backup.  These include POSIX ACLs (system.posix_acl_*),
+ * file capabilities (security.capability) and SELinux
+ * labels (security.selinux).
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Extended attributes go in the archive as PAX records
+// with this prefix, the way GNU tar and star store them.
+const XattrPrefix = "SCHILY.xattr."
+
+func AssignXattrs(prefixedPath string, info os.FileInfo, hdr *tar.Header) error {
+	// We can only read a symlink's own attributes with
+	// lgetxattr, which syscall doesn't have:
+	if (info.Mode() & os.ModeSymlink) != 0 {
+		return nil
+	}
+
+	names, err := listXattrs(prefixedPath)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(names); i++ {
+		value, err := getXattr(prefixedPath, names[i])
+		if err == syscall.ENODATA {
+			// It went away whilst we were looking.
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+
+		hdr.PAXRecords[XattrPrefix+names[i]] = string(value)
+	}
+
+	return nil
+}
+
+// Restores the extended attributes of the file, except
+// for those in namespaces (e.g. "security") or with names
+// in the skip list.
+// This needs doing after the ownership, because changing
+// the owner clears security.capability.
+func RestoreXattrs(path string, hdr *tar.Header, skip []string) (err error) {
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, XattrPrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, XattrPrefix)
+		if skipXattr(name, skip) {
+			continue
+		}
+
+		// Carry on with the rest if one fails:
+		setErr := syscall.Setxattr(path, name, []byte(value), 0)
+		if setErr != nil && err == nil {
+			err = &os.PathError{Op: "setxattr " + name, Path: path, Err: setErr}
+		}
+	}
+
+	return err
+}
+
+func skipXattr(name string, skip []string) bool {
+	namespace := strings.SplitN(name, ".", 2)[0]
+	for i := 0; i < len(skip); i++ {
+		if skip[i] == name || skip[i] == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+func listXattrs(path string) ([]string, error) {
+	buf, err := readXattrBuffer(func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+
+	// Not every filesystem has extended attributes:
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+
+	return names, nil
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	return readXattrBuffer(func(dest []byte) (int, error) {
+		return syscall.Getxattr(path, name, dest)
+	})
+}
+
+// Asks for the size first, then reads, trying again if
+// the attributes grew in between.
+func readXattrBuffer(read func([]byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		size, err = read(buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return buf[:size], nil
+	}
+}
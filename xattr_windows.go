@@ -0,0 +1,20 @@
+/* Windows specific package for handling extended attributes
+ * in backup.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+)
+
+func AssignXattrs(prefixedPath string, info os.FileInfo, hdr *tar.Header) error {
+	// Do nothing.  We don't support ACLs etc on Windows.
+	return nil
+}
+
+func RestoreXattrs(path string, hdr *tar.Header, skip []string) error {
+	// Do nothing.  We don't support ACLs etc on Windows.
+	return nil
+}